@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// unknownPowerEvent is the power event type counted when a source reports
+// going on battery but not what caused it.
+const unknownPowerEvent = "Unknown"
+
+// upsCounters are the monotonically increasing totals of a UPS, they are
+// persisted to -state-file so they survive restarts.
+type upsCounters struct {
+	EnergyWattHours    float64            `json:"energy_watt_hours"`
+	EnergyCost         float64            `json:"energy_cost"`
+	OnBatterySeconds   float64            `json:"on_battery_seconds"`
+	PowerEvents        map[string]float64 `json:"power_events"`
+	LastPowerEventTime time.Time          `json:"last_power_event_time"`
+}
+
+// clone returns a deep copy of c.
+func (c upsCounters) clone() upsCounters {
+	var events = make(map[string]float64, len(c.PowerEvents))
+	for eventType, count := range c.PowerEvents {
+		events[eventType] = count
+	}
+	c.PowerEvents = events
+	return c
+}
+
+// upsMeter turns successive readings of a UPS into upsCounters.
+type upsMeter struct {
+	pricePerKWh float64
+
+	seenReading   bool
+	lastSample    time.Time
+	lastWatts     int
+	lastOnBattery bool
+}
+
+// add accounts for a reading. Energy is the trapezoid of load watts between it
+// and the previous reading, time on battery is counted from the previous
+// reading's power supply.
+func (m *upsMeter) add(counters *upsCounters, status DeviceStatus) {
+	var at = status.CollectionTime
+	var onBattery = status.PowerSupplyBy == "Battery Power"
+
+	if !m.lastSample.IsZero() && at.After(m.lastSample) {
+		var elapsed = at.Sub(m.lastSample)
+		var wattHours = float64(m.lastWatts+status.LoadWatts) / 2 * elapsed.Hours()
+		counters.EnergyWattHours += wattHours
+		counters.EnergyCost += wattHours / 1000 * m.pricePerKWh
+		if m.lastOnBattery {
+			counters.OnBatterySeconds += elapsed.Seconds()
+		}
+	}
+
+	if counters.PowerEvents == nil {
+		counters.PowerEvents = map[string]float64{}
+	}
+	switch {
+	case status.LastPowerEventTime.After(counters.LastPowerEventTime):
+		// the very first event we see may be ancient history, it is only a
+		// baseline unless we have read the UPS before
+		if m.seenReading || !counters.LastPowerEventTime.IsZero() {
+			counters.PowerEvents[status.LastPowerEvent]++
+		}
+		counters.LastPowerEventTime = status.LastPowerEventTime
+	case status.LastPowerEventTime.IsZero() && onBattery && !m.lastSample.IsZero() && !m.lastOnBattery:
+		// sources without an event log only tell us we went on battery
+		counters.PowerEvents[unknownPowerEvent]++
+	}
+
+	m.seenReading = true
+	m.lastSample, m.lastWatts, m.lastOnBattery = at, status.LoadWatts, onBattery
+}
+
+// reset forgets the previous reading so we do not integrate across a gap in
+// readings, we do not know what happened in between.
+func (m *upsMeter) reset() {
+	m.lastSample = time.Time{}
+}
+
+// persistedState is the contents of -state-file.
+type persistedState struct {
+	UPS map[string]upsCounters `json:"ups"`
+}
+
+// loadState reads the state file, a missing file is an empty state.
+func loadState(path string) (persistedState, error) {
+	var state = persistedState{UPS: map[string]upsCounters{}}
+
+	var data, err = os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("unable to read state file %s, err: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("unable to parse state file %s, err: %w", path, err)
+	}
+	if state.UPS == nil {
+		state.UPS = map[string]upsCounters{}
+	}
+	return state, nil
+}
+
+// saveState writes the state file atomically so a crash mid write does not
+// lose the totals.
+func saveState(path string, state persistedState) error {
+	var data, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode state, err: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temp state file, err: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("unable to write state file, err: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write state file, err: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace state file %s, err: %w", path, err)
+	}
+	return nil
+}
+
+// saveMonitors persists the counters of every monitor to path.
+func saveMonitors(path string, monitors []*upsMonitor) error {
+	var state = persistedState{UPS: make(map[string]upsCounters, len(monitors))}
+	for _, monitor := range monitors {
+		state.UPS[monitor.name] = monitor.snapshotCounters()
+	}
+	return saveState(path, state)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUPSMeterEnergy(t *testing.T) {
+	t.Parallel()
+
+	var start = time.Date(2023, 3, 9, 12, 0, 0, 0, time.UTC)
+	var meter = upsMeter{pricePerKWh: 0.25}
+	var counters upsCounters
+	var reading = func(watts int, at time.Time) DeviceStatus {
+		return DeviceStatus{PowerSupplyBy: "Utility Power", LoadWatts: watts, CollectionTime: at}
+	}
+
+	// the first reading only sets the baseline
+	meter.add(&counters, reading(100, start))
+	assert.Zero(t, counters.EnergyWattHours)
+
+	// 100W -> 300W over half an hour averages 200W, 100Wh
+	meter.add(&counters, reading(300, start.Add(30*time.Minute)))
+	assert.InDelta(t, 100, counters.EnergyWattHours, 1e-9)
+	assert.InDelta(t, 0.025, counters.EnergyCost, 1e-9)
+
+	// nothing is counted across a gap in readings
+	meter.reset()
+	meter.add(&counters, reading(300, start.Add(5*time.Hour)))
+	assert.InDelta(t, 100, counters.EnergyWattHours, 1e-9)
+
+	meter.add(&counters, reading(300, start.Add(6*time.Hour)))
+	assert.InDelta(t, 400, counters.EnergyWattHours, 1e-9)
+	assert.Zero(t, counters.OnBatterySeconds)
+}
+
+func TestUPSMeterPowerEvents(t *testing.T) {
+	t.Parallel()
+
+	var start = time.Date(2023, 3, 9, 12, 0, 0, 0, time.UTC)
+	var oldEvent = start.Add(-24 * time.Hour)
+	var meter upsMeter
+	var counters upsCounters
+	var reading = func(supply, event string, eventTime, at time.Time) DeviceStatus {
+		return DeviceStatus{PowerSupplyBy: supply, LastPowerEvent: event, LastPowerEventTime: eventTime, CollectionTime: at}
+	}
+
+	// an event from before we started is only a baseline
+	meter.add(&counters, reading("Utility Power", "Blackout", oldEvent, start))
+	assert.Empty(t, counters.PowerEvents)
+
+	// two blackouts a minute apart are two events
+	meter.add(&counters, reading("Battery Power", "Blackout", start.Add(5*time.Second), start.Add(10*time.Second)))
+	meter.add(&counters, reading("Battery Power", "Blackout", start.Add(5*time.Second), start.Add(20*time.Second)))
+	meter.add(&counters, reading("Utility Power", "Blackout", start.Add(5*time.Second), start.Add(30*time.Second)))
+	meter.add(&counters, reading("Utility Power", "Under Voltage", start.Add(time.Minute), start.Add(70*time.Second)))
+	assert.Equal(t, map[string]float64{"Blackout": 1, "Under Voltage": 1}, counters.PowerEvents)
+	assert.InDelta(t, 20, counters.OnBatterySeconds, 1e-9)
+
+	// after a restart an event that happened while we were down is counted
+	var restarted upsMeter
+	restarted.add(&counters, reading("Utility Power", "Over Voltage", start.Add(time.Hour), start.Add(2*time.Hour)))
+	assert.Equal(t, map[string]float64{"Blackout": 1, "Under Voltage": 1, "Over Voltage": 1}, counters.PowerEvents)
+
+	// sources without an event log count going on battery
+	var noLog upsMeter
+	var noLogCounters upsCounters
+	noLog.add(&noLogCounters, reading("Utility Power", "None", time.Time{}, start))
+	noLog.add(&noLogCounters, reading("Battery Power", "None", time.Time{}, start.Add(time.Second)))
+	noLog.add(&noLogCounters, reading("Battery Power", "None", time.Time{}, start.Add(2*time.Second)))
+	assert.Equal(t, map[string]float64{unknownPowerEvent: 1}, noLogCounters.PowerEvents)
+	assert.InDelta(t, 1, noLogCounters.OnBatterySeconds, 1e-9)
+}
+
+func TestStateFile(t *testing.T) {
+	t.Parallel()
+
+	var path = filepath.Join(t.TempDir(), "state.json")
+
+	var state, err = loadState(path)
+	assert.NoError(t, err)
+	assert.Empty(t, state.UPS)
+
+	var monitor = newUPSMonitor("rack1", fakePwrstatSource(testOutputNormal, nil), time.Minute)
+	var counters = upsCounters{
+		EnergyWattHours:    1234.5,
+		EnergyCost:         0.3,
+		OnBatterySeconds:   61,
+		PowerEvents:        map[string]float64{"Blackout": 2},
+		LastPowerEventTime: time.Date(2023, 3, 9, 12, 55, 9, 0, time.UTC),
+	}
+	monitor.restoreCounters(counters)
+	assert.NoError(t, saveMonitors(path, []*upsMonitor{monitor}))
+
+	state, err = loadState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]upsCounters{"rack1": counters}, state.UPS)
+
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = loadState(path)
+	assert.Error(t, err)
+}
+
+func TestUPSCollectorCounters(t *testing.T) {
+	t.Parallel()
+
+	var monitor = newUPSMonitor("cyberpower", fakePwrstatSource(testOutputNormal, nil), 0)
+	monitor.restoreCounters(upsCounters{
+		EnergyWattHours:    1000,
+		EnergyCost:         0.25,
+		OnBatterySeconds:   30,
+		PowerEvents:        map[string]float64{"Blackout": 2},
+		LastPowerEventTime: time.Date(2023, 3, 9, 12, 55, 9, 0, testLocation),
+	})
+	var collector = NewUPSCollector(monitor)
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_energy_watt_hours_total energy delivered to the load, integrated from load watts
+# TYPE cyber_power_exporter_energy_watt_hours_total counter
+cyber_power_exporter_energy_watt_hours_total{ups="cyberpower"} 1000
+# HELP cyber_power_exporter_on_battery_seconds_total time spent running on battery
+# TYPE cyber_power_exporter_on_battery_seconds_total counter
+cyber_power_exporter_on_battery_seconds_total{ups="cyberpower"} 30
+# HELP cyber_power_exporter_power_events_total power events by type
+# TYPE cyber_power_exporter_power_events_total counter
+cyber_power_exporter_power_events_total{type="Blackout",ups="cyberpower"} 2
+`), "cyber_power_exporter_energy_watt_hours_total", "cyber_power_exporter_energy_cost_total",
+		"cyber_power_exporter_on_battery_seconds_total", "cyber_power_exporter_power_events_total"))
+
+	// a second reading at a constant 120W keeps counting up from the restored total
+	monitor.meter.pricePerKWh = 0.25
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "cyber_power_exporter_energy_cost_total"))
+	var counters = monitor.snapshotCounters()
+	assert.Greater(t, counters.EnergyWattHours, 1000.0)
+	assert.Greater(t, counters.EnergyCost, 0.25)
+}
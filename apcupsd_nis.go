@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNISCommandTooLong = errors.New("nis command is too long")
+
+// nisDateFormat is the date format apcupsd uses in status and events.
+const nisDateFormat = "2006-01-02 15:04:05 -0700"
+
+// nisMaxCommandLen bounds the command a client can send, apcupsd only knows
+// "status" and "events".
+const nisMaxCommandLen = 512
+
+// nisTransferReasons maps pwrstat power events onto apcupsd's LASTXFER text.
+// nolint: gochecknoglobals
+var nisTransferReasons = map[string]string{
+	"None":          "No transfers since turnon",
+	"Blackout":      "Low line voltage",
+	"Under Voltage": "Low line voltage",
+	"Over Voltage":  "High line voltage",
+}
+
+// nisSelfTestResults maps pwrstat test results onto apcupsd's SELFTEST codes.
+// nolint: gochecknoglobals
+var nisSelfTestResults = map[string]string{
+	"Passed":      "OK",
+	"None":        "NO",
+	"In progress": "IP",
+	"Warning":     "WN",
+	"Error":       "NG",
+	"Failed":      "BT",
+}
+
+// nisServer emulates the apcupsd Network Information Server so apcaccess,
+// Home Assistant and other apcupsd clients can read a CyberPower UPS.
+type nisServer struct {
+	provider  statusProvider
+	hostname  string
+	startTime time.Time
+}
+
+func newNISServer(provider statusProvider) *nisServer {
+	var hostname, err = os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &nisServer{provider: provider, hostname: hostname, startTime: time.Now()}
+}
+
+// Serve accepts connections on listener until it is closed.
+func (s *nisServer) Serve(listener net.Listener) error {
+	for {
+		var conn, err = listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("nis server accept error: %w", err)
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *nisServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(nutIdleTimeout))
+
+		var command, err = readNISRecord(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugf("nis server read error: %s", err)
+			}
+			return
+		}
+
+		var records []string
+		switch strings.TrimSpace(command) {
+		case "status":
+			records = s.status(time.Now())
+		case "events":
+			records = s.events()
+		default:
+			records = []string{"Invalid command\n"}
+		}
+
+		if err := writeNISRecords(conn, records); err != nil {
+			log.Debugf("nis server write error: %s", err)
+			return
+		}
+	}
+}
+
+// status renders the latest reading as apcupsd "KEY : value" records.
+func (s *nisServer) status(now time.Time) []string {
+	var device, status, err = s.provider.Latest()
+
+	var lines = [][2]string{
+		{"DATE", now.Format(nisDateFormat)},
+		{"HOSTNAME", s.hostname},
+		{"VERSION", "3.14.14 (cyberpower_exporter) linux"},
+		{"UPSNAME", s.hostname},
+		{"CABLE", "USB Cable"},
+		{"DRIVER", "USB UPS Driver"},
+		{"UPSMODE", "Stand Alone"},
+		{"STARTTIME", s.startTime.Format(nisDateFormat)},
+	}
+
+	if err != nil || status.State == "Lost Communication" {
+		lines = append(lines, [2]string{"STATUS", "COMMLOST"})
+	} else {
+		var upsStatus = "ONLINE"
+		if status.PowerSupplyBy == "Battery Power" {
+			upsStatus = "ONBATT"
+		}
+
+		var lastXfer = nisTransferReasons[status.LastPowerEvent]
+		if lastXfer == "" {
+			lastXfer = status.LastPowerEvent
+		}
+		var selfTest = nisSelfTestResults[status.TestResult]
+		if selfTest == "" {
+			selfTest = "NG"
+		}
+
+		lines = append(lines,
+			[2]string{"MODEL", device.ModelName},
+			[2]string{"STATUS", upsStatus},
+			[2]string{"LINEV", fmt.Sprintf("%.1f Volts", float64(status.UtilityVoltage))},
+			[2]string{"LOADPCT", fmt.Sprintf("%.1f Percent", float64(status.LoadPct))},
+			[2]string{"BCHARGE", fmt.Sprintf("%.1f Percent", float64(status.BatteryCapacity))},
+			[2]string{"TIMELEFT", fmt.Sprintf("%.1f Minutes", status.RemainingRuntime.Minutes())},
+			[2]string{"OUTPUTV", fmt.Sprintf("%.1f Volts", float64(status.OutputVoltage))},
+			[2]string{"LASTXFER", lastXfer},
+		)
+		if !status.LastPowerEventTime.IsZero() {
+			lines = append(lines, [2]string{"XONBATT", status.LastPowerEventTime.Format(nisDateFormat)})
+		}
+		lines = append(lines, [2]string{"SELFTEST", selfTest})
+		if !status.TestResultTime.IsZero() {
+			lines = append(lines, [2]string{"LASTSTEST", status.TestResultTime.Format(nisDateFormat)})
+		}
+		lines = append(lines,
+			[2]string{"NOMINV", fmt.Sprintf("%d Volts", device.RatingVoltage)},
+			[2]string{"NOMAPNT", fmt.Sprintf("%d VA", device.RatingPowerVA)},
+			[2]string{"NOMPOWER", fmt.Sprintf("%d Watts", device.RatingPowerWatts)},
+			[2]string{"FIRMWARE", device.FirmwareNumber},
+		)
+	}
+
+	lines = append(lines, [2]string{"END APC", now.Format(nisDateFormat)})
+
+	var records = make([]string, 0, len(lines)+1)
+	var size int
+	for _, line := range lines {
+		var record = fmt.Sprintf("%-9s: %s\n", line[0], line[1])
+		records = append(records, record)
+		size += len(record)
+	}
+
+	// the header carries the record count and byte length, itself included
+	var header = fmt.Sprintf("APC      : 001,%03d,%04d\n", len(records)+1, size+len("APC      : 001,000,0000\n"))
+	return append([]string{header}, records...)
+}
+
+// events synthesizes apcupsd's event log from the last power event pwrstat
+// knows about, we do not keep a log of our own.
+func (s *nisServer) events() []string {
+	var _, status, err = s.provider.Latest()
+	if err != nil || status.LastPowerEventTime.IsZero() {
+		return nil
+	}
+
+	var records = []string{fmt.Sprintf("%s  Power failure.\n", status.LastPowerEventTime.Format(nisDateFormat))}
+	if status.LastPowerEventDuration > 0 {
+		records = append(records, fmt.Sprintf("%s  Power is back. UPS running on mains.\n",
+			status.LastPowerEventTime.Add(status.LastPowerEventDuration).Format(nisDateFormat)))
+	}
+	return records
+}
+
+// readNISRecord reads a record prefixed by its big endian 16 bit length.
+func readNISRecord(r io.Reader) (string, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", fmt.Errorf("unable to read nis command length, err: %w", err)
+	}
+	if size > nisMaxCommandLen {
+		return "", fmt.Errorf("%w: %d bytes", errNISCommandTooLong, size)
+	}
+
+	var buf = make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("unable to read nis command, err: %w", err)
+	}
+	return string(buf), nil
+}
+
+// writeNISRecords writes each record with its length prefix followed by the
+// zero length record that ends a response.
+func writeNISRecords(w io.Writer, records []string) error {
+	var buf []byte
+	for _, record := range records {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(record)))
+		buf = append(buf, record...)
+	}
+	buf = append(buf, 0, 0)
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("unable to write nis response, err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nisQuery sends a command to a NIS server and returns the response records.
+func nisQuery(t *testing.T, addr, command string) []string {
+	t.Helper()
+
+	var conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var request bytes.Buffer
+	assert.NoError(t, writeNISRecords(&request, []string{command}))
+	_, err = conn.Write(request.Bytes()[:request.Len()-2]) // no terminator for requests
+	assert.NoError(t, err)
+
+	var records []string
+	for {
+		record, err := readNISRecord(conn)
+		assert.NoError(t, err)
+		if record == "" {
+			return records
+		}
+		records = append(records, record)
+	}
+}
+
+func startNISServer(t *testing.T, provider statusProvider) string {
+	t.Helper()
+
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var server = newNISServer(provider)
+	server.hostname = "nas"
+	go func() { _ = server.Serve(listener) }()
+	return listener.Addr().String()
+}
+
+func TestNISStatus(t *testing.T) {
+	t.Parallel()
+
+	var addr = startNISServer(t, newFakeStatusProvider(t, testOutputNormal))
+	var records = nisQuery(t, addr, "status")
+
+	var total int
+	var values = map[string]string{}
+	for _, record := range records {
+		total += len(record)
+		var key, val, found = strings.Cut(record, ":")
+		assert.True(t, found, record)
+		values[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+
+	assert.Len(t, records, 25)
+	assert.Equal(t, fmt.Sprintf("001,025,%04d", total), values["APC"])
+	assert.Equal(t, "nas", values["UPSNAME"])
+	assert.Equal(t, "CP1500PFCLCDa", values["MODEL"])
+	assert.Equal(t, "ONLINE", values["STATUS"])
+	assert.Equal(t, "122.0 Volts", values["LINEV"])
+	assert.Equal(t, "122.0 Volts", values["OUTPUTV"])
+	assert.Equal(t, "46.0 Percent", values["BCHARGE"])
+	assert.Equal(t, "28.0 Minutes", values["TIMELEFT"])
+	assert.Equal(t, "12.0 Percent", values["LOADPCT"])
+	assert.Equal(t, "1000 Watts", values["NOMPOWER"])
+	assert.Equal(t, "Low line voltage", values["LASTXFER"])
+	assert.Equal(t, "OK", values["SELFTEST"])
+	assert.Equal(t, "CR01802B7H21", values["FIRMWARE"])
+	assert.Equal(t, "2023-03-09 12:55:09 -0500", values["XONBATT"])
+	assert.True(t, strings.HasPrefix(records[len(records)-1], "END APC  : "))
+}
+
+func TestNISStatusCommLost(t *testing.T) {
+	t.Parallel()
+
+	var addr = startNISServer(t, &fakeStatusProvider{err: errors.New("pwrstatd is not running")})
+	var records = nisQuery(t, addr, "status")
+
+	assert.Contains(t, records, "STATUS   : COMMLOST\n")
+	assert.NotContains(t, strings.Join(records, ""), "BCHARGE")
+}
+
+func TestNISEvents(t *testing.T) {
+	t.Parallel()
+
+	var addr = startNISServer(t, newFakeStatusProvider(t, testOutputNormal))
+	assert.Equal(t, []string{
+		"2023-03-09 12:55:09 -0500  Power failure.\n",
+		"2023-03-09 12:55:12 -0500  Power is back. UPS running on mains.\n",
+	}, nisQuery(t, addr, "events"))
+
+	assert.Equal(t, []string{"Invalid command\n"}, nisQuery(t, addr, "bogus"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiStatus is the body of /api/v1/status/{ups}, a statusDocument of the last
+// good reading of a UPS plus how old it is and why the latest read failed, if
+// it did. Fields are only ever added to it, they are listed in the README.
+//
+//	{
+//	  "ups": "rack1",
+//	  "model_name": "CP1500PFCLCDa",
+//	  ...
+//	  "collection_time": "2023-03-09T13:38:21Z",
+//	  "collection_age_seconds": 2.5,
+//	  "last_error": "pwrstatd is not running"
+//	}
+type apiStatus struct {
+	statusDocument
+	// CollectionAgeSeconds is how long ago the last good reading was taken,
+	// left out if there has not been one.
+	CollectionAgeSeconds *float64 `json:"collection_age_seconds,omitempty"`
+	// LastError is why the latest read failed, left out if it did not.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// apiStatusList is the body of /api/v1/status, the status of every UPS
+// whether one or many are configured.
+//
+//	{"ups": [{"ups": "rack1", ...}, {"ups": "rack2", ...}]}
+type apiStatusList struct {
+	UPS []apiStatus `json:"ups"`
+}
+
+// apiError is the body of a failed API request.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// statusAPI serves the latest reading of each UPS as JSON.
+type statusAPI struct {
+	monitors []*upsMonitor
+	now      func() time.Time
+}
+
+func newStatusAPI(monitors []*upsMonitor) *statusAPI {
+	return &statusAPI{monitors: monitors, now: time.Now}
+}
+
+// register adds the API routes to mux.
+func (a *statusAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/status", a.list)
+	mux.HandleFunc("GET /api/v1/status/{ups}", a.one)
+}
+
+// list serves the status of every UPS.
+func (a *statusAPI) list(w http.ResponseWriter, _ *http.Request) {
+	var list = apiStatusList{UPS: make([]apiStatus, 0, len(a.monitors))}
+	for _, monitor := range a.monitors {
+		list.UPS = append(list.UPS, a.status(monitor))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// one serves the status of the UPS named in the path.
+func (a *statusAPI) one(w http.ResponseWriter, r *http.Request) {
+	var name = r.PathValue("ups")
+	for _, monitor := range a.monitors {
+		if monitor.name == name {
+			writeJSON(w, http.StatusOK, a.status(monitor))
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, apiError{Error: "unknown ups " + name})
+}
+
+func (a *statusAPI) status(monitor *upsMonitor) apiStatus {
+	var snap = monitor.snapshot()
+
+	var status = apiStatus{statusDocument: newStatusDocument(monitor.name, snap.device, snap.status)}
+	if !snap.lastSuccess.IsZero() {
+		var age = a.now().Sub(snap.lastSuccess).Seconds()
+		status.CollectionAgeSeconds = &age
+	}
+	if snap.err != nil {
+		status.LastError = snap.err.Error()
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("unable to write api response, err: %s", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getJSON(t *testing.T, handler http.Handler, path string, body any) int {
+	t.Helper()
+
+	var rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), body))
+	return rec.Code
+}
+
+func TestStatusAPI(t *testing.T) {
+	t.Parallel()
+
+	var out, outErr = testOutputBlackout, error(nil)
+	var flaky = fakePwrstatSource("", nil)
+	flaky.getStats = func(context.Context, string) (string, error) { return out, outErr }
+
+	var api = newStatusAPI([]*upsMonitor{
+		newUPSMonitor("rack1", fakePwrstatSource(testOutputNormal, nil), time.Minute),
+		newUPSMonitor("rack2", flaky, 0),
+	})
+	var mux = http.NewServeMux()
+	api.register(mux)
+
+	var list struct {
+		UPS []map[string]any `json:"ups"`
+	}
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/status", &list))
+	var statuses = list.UPS
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "rack1", statuses[0]["ups"])
+	assert.Equal(t, "Normal", statuses[0]["state"])
+	assert.Equal(t, "rack2", statuses[1]["ups"])
+	assert.Equal(t, "Power Failure", statuses[1]["state"])
+
+	// a failed read keeps the last good reading and says why
+	outErr = errors.New("pwrstatd is not running")
+	api.now = func() time.Time { return time.Now().Add(time.Hour) }
+	var status map[string]any
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/status/rack2", &status))
+	assert.Equal(t, "Power Failure", status["state"])
+	assert.Equal(t, float64(39), status["battery_capacity"])
+	assert.Equal(t, float64(1440), status["remaining_runtime_seconds"])
+	assert.Equal(t, "CP1500PFCLCDa", status["model_name"])
+	assert.Contains(t, status["last_error"], "pwrstatd is not running")
+	assert.InDelta(t, time.Hour.Seconds(), status["collection_age_seconds"], 60)
+	_, err := time.Parse(time.RFC3339, status["collection_time"].(string))
+	assert.NoError(t, err)
+
+	var apiErr apiError
+	assert.Equal(t, http.StatusNotFound, getJSON(t, mux, "/api/v1/status/rack3", &apiErr))
+	assert.Equal(t, "unknown ups rack3", apiErr.Error)
+
+	// a single ups is still a list
+	api.monitors = api.monitors[:1]
+	list.UPS = nil
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/status", &list))
+	assert.Len(t, list.UPS, 1)
+	assert.Equal(t, "rack1", list.UPS[0]["ups"])
+	assert.NotContains(t, list.UPS[0], "last_error")
+}
@@ -0,0 +1,113 @@
+// Command fake-pwrstat prints pwrstat -status output from a scenario file so
+// the exporter can be run and tested without a UPS. Point -cmd-path at it:
+//
+//	FAKE_PWRSTAT_SCENARIO=scenario.example.yml cyberpower_exporter -cmd-path $(which fake-pwrstat)
+//
+// The scenario starts on the first run, its progress is kept in a state file
+// next to it. Delete the state file to start over.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+var errNoStatus = errors.New("only -status is supported")
+
+// runState is the progress through a scenario, kept between runs.
+type runState struct {
+	Start time.Time `json:"start"`
+	Calls int64     `json:"calls"`
+}
+
+func main() {
+	var status bool
+	var scenarioPath, statePath string
+	flag.BoolVar(&status, "status", false, "print the UPS status, like pwrstat -status")
+	flag.StringVar(&scenarioPath, "scenario", os.Getenv("FAKE_PWRSTAT_SCENARIO"), "scenario file, defaults to $FAKE_PWRSTAT_SCENARIO. Without one a normal UPS on utility power is printed")
+	flag.StringVar(&statePath, "state", os.Getenv("FAKE_PWRSTAT_STATE"), "file to keep the progress through the scenario in, defaults to $FAKE_PWRSTAT_STATE or the scenario path with .state appended")
+	flag.Parse()
+
+	if !status {
+		fmt.Fprintln(os.Stderr, errNoStatus)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var st, d, err = current(scenarioPath, statePath, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	time.Sleep(st.Hang)
+	if st.ExitStatus != 0 {
+		fmt.Fprint(os.Stderr, st.Stderr)
+		os.Exit(st.ExitStatus)
+	}
+	fmt.Print(st.render(d))
+}
+
+// current returns the step of the scenario to print now and counts the run.
+func current(scenarioPath, statePath string, now time.Time) (step, device, error) {
+	if scenarioPath == "" {
+		return defaultStep, defaultDevice, nil
+	}
+
+	var s, err = loadScenario(scenarioPath)
+	if err != nil {
+		return step{}, device{}, err
+	}
+
+	if statePath == "" {
+		statePath = scenarioPath + ".state"
+	}
+	state, err := readState(statePath, now)
+	if err != nil {
+		return step{}, device{}, err
+	}
+
+	var position = int64(now.Sub(state.Start))
+	if s.Steps[0].Calls > 0 {
+		position = state.Calls
+	}
+	state.Calls++
+	if err := writeState(statePath, state); err != nil {
+		return step{}, device{}, err
+	}
+
+	return s.at(position), s.Device, nil
+}
+
+// readState reads the progress through the scenario, a missing file starts
+// the scenario now.
+func readState(path string, now time.Time) (runState, error) {
+	var data, err = os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return runState{Start: now}, nil
+	} else if err != nil {
+		return runState{}, fmt.Errorf("unable to read state: %s, err: %w", path, err)
+	}
+
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return runState{}, fmt.Errorf("unable to parse state: %s, err: %w", path, err)
+	}
+	return state, nil
+}
+
+func writeState(path string, state runState) error {
+	var data, err = json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to marshal state, err: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write state: %s, err: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errNoSteps      = errors.New("scenario has no steps")
+	errStepLength   = errors.New("every step needs a duration, or every step calls")
+	errInvalidStep  = errors.New("invalid step")
+	errUnknownState = errors.New("unknown state")
+)
+
+// dateFormat is how pwrstat prints times.
+const dateFormat = "2006/01/02 15:04:05"
+
+// device is the Properties section of pwrstat -status.
+type device struct {
+	ModelName        string `yaml:"model_name"`
+	FirmwareNumber   string `yaml:"firmware_number"`
+	RatingVoltage    int    `yaml:"rating_voltage"`
+	RatingPowerWatts int    `yaml:"rating_power_watts"`
+	RatingPowerVA    int    `yaml:"rating_power_va"`
+}
+
+// step is what the UPS reports for a while. Keys a step leaves out keep the
+// value of the step before it, so a scenario only spells out what changes.
+type step struct {
+	Name string `yaml:"name"`
+	// how long the step lasts, either wall time or a number of pwrstat runs
+	Duration time.Duration `yaml:"duration"`
+	Calls    int           `yaml:"calls"`
+
+	State            string        `yaml:"state"`
+	PowerSupply      string        `yaml:"power_supply"`
+	UtilityVoltage   int           `yaml:"utility_voltage"`
+	OutputVoltage    int           `yaml:"output_voltage"`
+	BatteryCapacity  int           `yaml:"battery_capacity"`
+	RemainingRuntime time.Duration `yaml:"remaining_runtime"`
+	LoadWatts        int           `yaml:"load_watts"`
+	LoadPct          int           `yaml:"load_pct"`
+	LineInteraction  string        `yaml:"line_interaction"`
+
+	// if set, battery capacity and remaining runtime move linearly to these
+	// over the step and the next step starts from them
+	BatteryCapacityEnd  *int           `yaml:"battery_capacity_end"`
+	RemainingRuntimeEnd *time.Duration `yaml:"remaining_runtime_end"`
+
+	TestResult             string        `yaml:"test_result"`
+	TestResultTime         string        `yaml:"test_result_time"`
+	LastPowerEvent         string        `yaml:"last_power_event"`
+	LastPowerEventTime     string        `yaml:"last_power_event_time"`
+	LastPowerEventDuration time.Duration `yaml:"last_power_event_duration"`
+
+	// fail like pwrstat does when pwrstatd is down, or hang before answering
+	ExitStatus int           `yaml:"exit_status"`
+	Stderr     string        `yaml:"stderr"`
+	Hang       time.Duration `yaml:"hang"`
+}
+
+// scenario is a script of UPS readings.
+type scenario struct {
+	Device device `yaml:"device"`
+	Loop   bool   `yaml:"loop"`
+	Steps  []step `yaml:"-"`
+}
+
+// defaultDevice and defaultStep are the readings of the fixtures in the
+// exporter's pwrstat_test.go, a scenario starts from them.
+// nolint: gochecknoglobals
+var (
+	defaultDevice = device{
+		ModelName:        "CP1500PFCLCDa",
+		FirmwareNumber:   "CR01802B7H21",
+		RatingVoltage:    120,
+		RatingPowerWatts: 1000,
+		RatingPowerVA:    1500,
+	}
+	defaultStep = step{
+		State:                  "Normal",
+		PowerSupply:            "Utility Power",
+		UtilityVoltage:         122,
+		OutputVoltage:          122,
+		BatteryCapacity:        46,
+		RemainingRuntime:       28 * time.Minute,
+		LoadWatts:              120,
+		LoadPct:                12,
+		LineInteraction:        "None",
+		TestResult:             "Passed",
+		TestResultTime:         "2023/03/09 13:25:33",
+		LastPowerEvent:         "Blackout",
+		LastPowerEventTime:     "2023/03/09 12:55:09",
+		LastPowerEventDuration: 3 * time.Second,
+	}
+)
+
+// states are the states pwrstat reports.
+// nolint: gochecknoglobals
+var states = map[string]bool{"Normal": true, "Power Failure": true, "Lost Communication": true}
+
+// loadScenario reads a scenario file.
+func loadScenario(path string) (scenario, error) {
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		return scenario{}, fmt.Errorf("unable to read scenario: %s, err: %w", path, err)
+	}
+
+	var raw struct {
+		Device *yaml.Node  `yaml:"device"`
+		Loop   bool        `yaml:"loop"`
+		Steps  []yaml.Node `yaml:"steps"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return scenario{}, fmt.Errorf("unable to parse scenario: %s, err: %w", path, err)
+	}
+
+	var s = scenario{Device: defaultDevice, Loop: raw.Loop}
+	if raw.Device != nil {
+		if err := raw.Device.Decode(&s.Device); err != nil {
+			return scenario{}, fmt.Errorf("unable to parse scenario: %s, device: %w", path, err)
+		}
+	}
+
+	// decode every step on top of the one before it
+	var next = defaultStep
+	for i, node := range raw.Steps {
+		var st = next
+		if err := node.Decode(&st); err != nil {
+			return scenario{}, fmt.Errorf("unable to parse scenario: %s, steps[%d]: %w", path, i, err)
+		}
+		if err := st.validate(); err != nil {
+			return scenario{}, fmt.Errorf("scenario: %s, steps[%d]: %w", path, i, err)
+		}
+		s.Steps = append(s.Steps, st)
+		next = st.carry()
+	}
+
+	if err := s.validate(); err != nil {
+		return scenario{}, fmt.Errorf("scenario: %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s scenario) validate() error {
+	if len(s.Steps) == 0 {
+		return errNoSteps
+	}
+	var byCalls = s.Steps[0].Calls > 0
+	for _, st := range s.Steps {
+		if (st.Calls > 0) != byCalls || (st.Duration > 0) == byCalls {
+			return errStepLength
+		}
+	}
+	return nil
+}
+
+func (st step) validate() error {
+	if st.Duration < 0 || st.Calls < 0 {
+		return fmt.Errorf("%w: duration and calls cannot be negative", errInvalidStep)
+	}
+	if !states[st.State] {
+		return fmt.Errorf("%w: %s", errUnknownState, st.State)
+	}
+	for _, t := range []string{st.TestResultTime, st.LastPowerEventTime} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(dateFormat, t); err != nil {
+			return fmt.Errorf("%w: time %q is not like %s", errInvalidStep, t, dateFormat)
+		}
+	}
+	return nil
+}
+
+// carry returns the step the next one is decoded on top of, it starts where
+// this one ended and does not fail.
+func (st step) carry() step {
+	if st.BatteryCapacityEnd != nil {
+		st.BatteryCapacity = *st.BatteryCapacityEnd
+	}
+	if st.RemainingRuntimeEnd != nil {
+		st.RemainingRuntime = *st.RemainingRuntimeEnd
+	}
+	st.Name, st.Duration, st.Calls = "", 0, 0
+	st.BatteryCapacityEnd, st.RemainingRuntimeEnd = nil, nil
+	st.ExitStatus, st.Stderr, st.Hang = 0, "", 0
+	return st
+}
+
+// length is how long a step lasts in the scenario's unit, nanoseconds or calls.
+func (st step) length() int64 {
+	if st.Calls > 0 {
+		return int64(st.Calls)
+	}
+	return int64(st.Duration)
+}
+
+// at returns the step at position, nanoseconds since the scenario started or
+// calls before this one, with the battery drained as far as it has got. A
+// scenario that does not loop stays on its last step.
+func (s scenario) at(position int64) step {
+	var total int64
+	for _, st := range s.Steps {
+		total += st.length()
+	}
+	if s.Loop {
+		position %= total
+	}
+
+	for i, st := range s.Steps {
+		if position < st.length() || i == len(s.Steps)-1 {
+			return st.drained(position, st.length())
+		}
+		position -= st.length()
+	}
+	return s.Steps[len(s.Steps)-1]
+}
+
+// drained moves battery capacity and remaining runtime position/length of the
+// way to their end values.
+func (st step) drained(position, length int64) step {
+	var fraction = 1.0
+	if st.Calls > 1 {
+		fraction = float64(position) / float64(length-1)
+	} else if st.Duration > 0 {
+		fraction = float64(position) / float64(length)
+	}
+	fraction = math.Min(fraction, 1)
+
+	if st.BatteryCapacityEnd != nil {
+		st.BatteryCapacity += int(math.Round(fraction * float64(*st.BatteryCapacityEnd-st.BatteryCapacity)))
+	}
+	if st.RemainingRuntimeEnd != nil {
+		st.RemainingRuntime += time.Duration(fraction * float64(*st.RemainingRuntimeEnd-st.RemainingRuntime))
+	}
+	return st
+}
+
+// render prints the step like pwrstat -status, in the layout of the fixtures
+// in the exporter's pwrstat_test.go.
+func (st step) render(d device) string {
+	var b strings.Builder
+	b.WriteString("\nThe UPS information shows as following:\n\n\tProperties:\n")
+	writeField(&b, "Model Name", d.ModelName)
+	writeField(&b, "Firmware Number", d.FirmwareNumber)
+	writeField(&b, "Rating Voltage", fmt.Sprintf("%d V", d.RatingVoltage))
+	writeField(&b, "Rating Power", fmt.Sprintf("%d Watt(%d VA)", d.RatingPowerWatts, d.RatingPowerVA))
+
+	b.WriteString("\n\tCurrent UPS status:\n")
+	writeField(&b, "State", st.State)
+	// pwrstat prints nothing but the state and last events when it cannot
+	// talk to the UPS
+	if st.State != "Lost Communication" {
+		writeField(&b, "Power Supply by", st.PowerSupply)
+		writeField(&b, "Utility Voltage", fmt.Sprintf("%d V", st.UtilityVoltage))
+		writeField(&b, "Output Voltage", fmt.Sprintf("%d V", st.OutputVoltage))
+		writeField(&b, "Battery Capacity", fmt.Sprintf("%d %%", st.BatteryCapacity))
+		writeField(&b, "Remaining Runtime", fmt.Sprintf("%d min.", int(st.RemainingRuntime.Minutes())))
+		writeField(&b, "Load", fmt.Sprintf("%d Watt(%d %%)", st.LoadWatts, st.LoadPct))
+		writeField(&b, "Line Interaction", st.LineInteraction)
+	}
+	writeField(&b, "Test Result", withTime(st.TestResult, st.TestResultTime))
+	writeField(&b, "Last Power Event", powerEvent(st.LastPowerEvent, st.LastPowerEventTime, st.LastPowerEventDuration))
+	if st.State == "Lost Communication" {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// writeField writes a line like "\t\tState........................ Normal".
+func writeField(b *strings.Builder, label, value string) {
+	const width = 29
+	fmt.Fprintf(b, "\t\t%s%s %s\n", label, strings.Repeat(".", width-len(label)), value)
+}
+
+func withTime(value, at string) string {
+	if at == "" || value == "None" {
+		return value
+	}
+	return value + " at " + at
+}
+
+func powerEvent(event, at string, duration time.Duration) string {
+	var value = withTime(event, at)
+	switch {
+	case value == event || duration <= 0:
+	case duration >= time.Minute:
+		value += fmt.Sprintf(" for %d min.", int(duration.Minutes()))
+	default:
+		value += fmt.Sprintf(" for %d sec.", int(duration.Seconds()))
+	}
+	return value
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testOutputNormal is testOutputNormal from the exporter's pwrstat_test.go.
+const testOutputNormal = `
+The UPS information shows as following:
+
+	Properties:
+		Model Name................... CP1500PFCLCDa
+		Firmware Number.............. CR01802B7H21
+		Rating Voltage............... 120 V
+		Rating Power................. 1000 Watt(1500 VA)
+
+	Current UPS status:
+		State........................ Normal
+		Power Supply by.............. Utility Power
+		Utility Voltage.............. 122 V
+		Output Voltage............... 122 V
+		Battery Capacity............. 46 %
+		Remaining Runtime............ 28 min.
+		Load......................... 120 Watt(12 %)
+		Line Interaction............. None
+		Test Result.................. Passed at 2023/03/09 13:25:33
+		Last Power Event............. Blackout at 2023/03/09 12:55:09 for 3 sec.
+`
+
+// testLostConnection is testLostConnection from the exporter's pwrstat_test.go.
+const testLostConnection = `
+The UPS information shows as following:
+
+	Properties:
+		Model Name................... CP1500PFCLCDa
+		Firmware Number.............. CR01802B7H21
+		Rating Voltage............... 120 V
+		Rating Power................. 1000 Watt(1500 VA)
+
+	Current UPS status:
+		State........................ Lost Communication
+		Test Result.................. Passed at 2025/01/21 13:13:05
+		Last Power Event............. Blackout at 2025/01/23 12:33:09
+
+`
+
+func writeScenario(t *testing.T, content string) string {
+	t.Helper()
+
+	var path = filepath.Join(t.TempDir(), "scenario.yml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, testOutputNormal, defaultStep.render(defaultDevice))
+
+	var lost = defaultStep
+	lost.State = "Lost Communication"
+	lost.TestResultTime = "2025/01/21 13:13:05"
+	lost.LastPowerEventTime = "2025/01/23 12:33:09"
+	lost.LastPowerEventDuration = 0
+	assert.Equal(t, testLostConnection, lost.render(defaultDevice))
+}
+
+func TestScenario(t *testing.T) {
+	t.Parallel()
+
+	var s, err = loadScenario(writeScenario(t, `
+steps:
+  - calls: 1
+    battery_capacity: 100
+  - calls: 5
+    state: Power Failure
+    power_supply: Battery Power
+    utility_voltage: 0
+    battery_capacity_end: 20
+    remaining_runtime: 40m
+    remaining_runtime_end: 0s
+    last_power_event_time: 2023/03/09 13:38:21
+    last_power_event_duration: 0s
+  - calls: 1
+    test_result: In progress
+    test_result_time: ""
+    exit_status: 1
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDevice, s.Device)
+
+	assert.Equal(t, "Normal", s.at(0).State)
+	assert.Equal(t, 100, s.at(0).BatteryCapacity)
+
+	// the battery drains over the calls of the step
+	assert.Equal(t, "Power Failure", s.at(1).State)
+	assert.Equal(t, 100, s.at(1).BatteryCapacity)
+	assert.Equal(t, 80, s.at(2).BatteryCapacity)
+	assert.Equal(t, 30*time.Minute, s.at(2).RemainingRuntime)
+	assert.Equal(t, 20, s.at(5).BatteryCapacity)
+	assert.Equal(t, time.Duration(0), s.at(5).RemainingRuntime)
+
+	// the next step starts where the last one ended and keeps what it does
+	// not change
+	var last = s.at(6)
+	assert.Equal(t, "Power Failure", last.State)
+	assert.Equal(t, 20, last.BatteryCapacity)
+	assert.Equal(t, 1, last.ExitStatus)
+	assert.Contains(t, last.render(s.Device), "Test Result.................. In progress\n")
+	assert.Contains(t, last.render(s.Device), "Last Power Event............. Blackout at 2023/03/09 13:38:21\n")
+
+	// without loop the last step is kept
+	assert.Equal(t, last, s.at(100))
+	s.Loop = true
+	assert.Equal(t, "Normal", s.at(7).State)
+}
+
+func TestScenarioByDuration(t *testing.T) {
+	t.Parallel()
+
+	var s, err = loadScenario(writeScenario(t, `
+loop: true
+steps:
+  - duration: 1m
+  - duration: 10m
+    state: Power Failure
+    battery_capacity: 100
+    battery_capacity_end: 0
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Normal", s.at(int64(30*time.Second)).State)
+	assert.Equal(t, 50, s.at(int64(6*time.Minute)).BatteryCapacity)
+	assert.Equal(t, "Normal", s.at(int64(11*time.Minute)).State)
+}
+
+func TestScenarioErrors(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		content string
+		want    string
+	}{
+		{"loop: true\n", errNoSteps.Error()},
+		{"steps:\n  - calls: 1\n    state: Blackout\n", "unknown state: Blackout"},
+		{"steps:\n  - calls: 1\n  - duration: 1m\n", errStepLength.Error()},
+		{"steps:\n  - calls: 1\n    test_result_time: yesterday\n", `time "yesterday" is not like`},
+		{"steps:\n  - calls: 1\n    battery_capacity: lots\n", "steps[0]"},
+	}
+	for _, test := range tests {
+		var _, err = loadScenario(writeScenario(t, test.content))
+		assert.ErrorContains(t, err, test.want, test.content)
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	t.Parallel()
+
+	var path = writeScenario(t, "steps:\n  - calls: 2\n  - calls: 1\n    state: Power Failure\n")
+	var now = time.Now()
+	for _, want := range []string{"Normal", "Normal", "Power Failure", "Power Failure"} {
+		var st, _, err = current(path, "", now)
+		assert.NoError(t, err)
+		assert.Equal(t, want, st.State)
+	}
+
+	state, err := readState(path+".state", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), state.Calls)
+
+	// without a scenario the UPS is fine
+	st, d, err := current("", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultStep, st)
+	assert.Equal(t, defaultDevice, d)
+}
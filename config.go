@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v3"
+)
+
+var errInvalidConfig = errors.New("invalid config")
+
+// knownEvents are the events that can be subscribed to.
+// nolint: gochecknoglobals
+var knownEvents = []string{
+	eventPowerFailure, eventPowerRestored, eventOnBattery, eventOnUtility,
+	eventCommunicationLost, eventCommunicationRestored, eventSelfTestFailed, eventLowBattery,
+}
+
+// configFile is everything the exporter is configured with. Flags fill it
+// in and a -config YAML file, see cyberpower_exporter.example.yml, is decoded
+// on top of them, so keys left out of the file keep their flag value.
+type configFile struct {
+	PollInterval      time.Duration  `yaml:"poll_interval"`
+	StateFile         string         `yaml:"state_file"`
+	EnergyPricePerKWh float64        `yaml:"energy_price_per_kwh"`
+	Record            recordSection  `yaml:"record"`
+	Listen            listenSection  `yaml:"listen"`
+	UPS               []upsSection   `yaml:"ups"`
+	Outputs           outputsSection `yaml:"outputs"`
+	Alerts            alertsSection  `yaml:"alerts"`
+
+	// the UPSs given by flags, used when the file lists none
+	upsFlags       stringsFlag
+	upsName        string
+	sourceKind     string
+	sourceDefaults sourceConfig
+}
+
+type listenSection struct {
+	Metrics       string           `yaml:"metrics"`
+	WebConfigFile string           `yaml:"web_config_file"`
+	NUT           nutServerSection `yaml:"nut"`
+	NIS           nisSection       `yaml:"nis"`
+}
+
+type nutServerSection struct {
+	Addr       string `yaml:"addr"`
+	LowBattery int    `yaml:"low_battery"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+}
+
+type nisSection struct {
+	Addr string `yaml:"addr"`
+	UPS  string `yaml:"ups"`
+}
+
+type recordSection struct {
+	Dir  string `yaml:"dir"`
+	Keep int    `yaml:"keep"`
+}
+
+// upsSection is a UPS of the file, options left out fall back to the source
+// flags and interval to poll_interval.
+type upsSection struct {
+	Name        string         `yaml:"name"`
+	Source      string         `yaml:"source"`
+	CmdPath     string         `yaml:"cmd_path"`
+	ExecTimeout time.Duration  `yaml:"exec_timeout"`
+	Device      string         `yaml:"device"`
+	Addr        string         `yaml:"addr"`
+	NUTUPS      string         `yaml:"nut_ups"`
+	Replay      string         `yaml:"replay"`
+	ReplaySpeed *float64       `yaml:"replay_speed"`
+	Interval    *time.Duration `yaml:"interval"`
+}
+
+type outputsSection struct {
+	MQTT     mqttSection    `yaml:"mqtt"`
+	Influx   influxSection  `yaml:"influx"`
+	Webhooks webhookSection `yaml:"webhooks"`
+	Hooks    hooksSection   `yaml:"hooks"`
+}
+
+type mqttSection struct {
+	Broker          string `yaml:"broker"`
+	ClientID        string `yaml:"client_id"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	TopicPrefix     string `yaml:"topic_prefix"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+}
+
+type influxSection struct {
+	URL           string        `yaml:"url"`
+	Version       int           `yaml:"version"`
+	Database      string        `yaml:"database"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	Org           string        `yaml:"org"`
+	Bucket        string        `yaml:"bucket"`
+	Token         string        `yaml:"token"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+type webhookSection struct {
+	URLs         []string      `yaml:"urls"`
+	TemplateFile string        `yaml:"template_file"`
+	ContentType  string        `yaml:"content_type"`
+	Events       []string      `yaml:"events"`
+	Dedup        time.Duration `yaml:"dedup"`
+	Retries      int           `yaml:"retries"`
+}
+
+type hooksSection struct {
+	Dir     string        `yaml:"dir"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type alertsSection struct {
+	LowBattery int             `yaml:"low_battery"`
+	Shutdown   shutdownSection `yaml:"shutdown"`
+}
+
+type shutdownSection struct {
+	BatteryCapacity  int           `yaml:"battery_capacity"`
+	RemainingRuntime time.Duration `yaml:"remaining_runtime"`
+	OnBattery        time.Duration `yaml:"on_battery"`
+	Grace            time.Duration `yaml:"grace"`
+	Exec             []string      `yaml:"exec"`
+	URLs             []string      `yaml:"urls"`
+	DryRun           bool          `yaml:"dry_run"`
+}
+
+// loadConfigFile decodes the YAML file at path on top of base and validates
+// the result. Unknown keys are errors, errors name the line or key at fault.
+func loadConfigFile(path string, base configFile) (configFile, error) {
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		return configFile{}, fmt.Errorf("unable to read config file %s, err: %w", path, err)
+	}
+
+	var config = base
+	var decoder = yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// an empty file is an empty config
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return configFile{}, fmt.Errorf("%w %s: %w", errInvalidConfig, path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return configFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// validate checks the values of the config, errors start with the key at
+// fault.
+func (c configFile) validate() error {
+	if c.PollInterval < 0 {
+		return fmt.Errorf("%w: poll_interval: must not be negative", errInvalidConfig)
+	}
+	if c.Listen.Metrics == "" {
+		return fmt.Errorf("%w: listen.metrics: must be set", errInvalidConfig)
+	}
+	if c.Listen.WebConfigFile != "" {
+		if err := web.Validate(c.Listen.WebConfigFile); err != nil {
+			return fmt.Errorf("%w: listen.web_config_file: %w", errInvalidConfig, err)
+		}
+	}
+	if c.Record.Keep < 0 {
+		return fmt.Errorf("%w: record.keep: must not be negative", errInvalidConfig)
+	}
+	if _, err := c.upsConfigs(); err != nil {
+		return err
+	}
+
+	if c.Outputs.Influx.URL != "" {
+		if _, err := c.influxConfig().writeURL(); err != nil {
+			return fmt.Errorf("%w: outputs.influx: %w", errInvalidConfig, err)
+		}
+		if c.Outputs.Influx.FlushInterval <= 0 {
+			return fmt.Errorf("%w: outputs.influx.flush_interval: must be positive", errInvalidConfig)
+		}
+	}
+	for i, event := range c.Outputs.Webhooks.Events {
+		if !slices.Contains(knownEvents, event) {
+			return fmt.Errorf("%w: outputs.webhooks.events[%d]: unknown event %q", errInvalidConfig, i, event)
+		}
+	}
+	if _, err := c.webhookConfig(); err != nil {
+		return fmt.Errorf("%w: outputs.webhooks.template_file: %w", errInvalidConfig, err)
+	}
+
+	if c.Alerts.LowBattery < 0 || c.Alerts.LowBattery > 100 {
+		return fmt.Errorf("%w: alerts.low_battery: must be between 0 and 100", errInvalidConfig)
+	}
+	if err := c.shutdownPolicy().validate(); err != nil {
+		return fmt.Errorf("%w: alerts.shutdown: %w", errInvalidConfig, err)
+	}
+	return nil
+}
+
+// upsConfigs returns the UPSs to monitor, the ones in the file if it lists
+// any, otherwise the ones given with -ups or else the single -source one.
+// Each UPS records to a directory of its own under record.dir.
+func (c configFile) upsConfigs() ([]upsConfig, error) {
+	var configs, err = c.listedUPS()
+	if err != nil {
+		return nil, err
+	}
+	if c.Record.Dir != "" {
+		for i := range configs {
+			configs[i].source.recordDir = filepath.Join(c.Record.Dir, configs[i].name)
+			configs[i].source.recordKeep = c.Record.Keep
+		}
+	}
+	return configs, nil
+}
+
+func (c configFile) listedUPS() ([]upsConfig, error) {
+	if len(c.UPS) == 0 {
+		if len(c.upsFlags) == 0 {
+			return []upsConfig{{name: c.upsName, kind: c.sourceKind, source: c.sourceDefaults, minInterval: c.PollInterval}}, nil
+		}
+		return parseUPSFlags(c.upsFlags, c.sourceDefaults, c.PollInterval)
+	}
+
+	var configs = make([]upsConfig, 0, len(c.UPS))
+	var seen = map[string]bool{}
+	for i, section := range c.UPS {
+		var config = upsConfig{name: section.Name, kind: section.Source, source: c.sourceDefaults, minInterval: c.PollInterval}
+		switch {
+		case section.Name == "":
+			return nil, fmt.Errorf("%w: ups[%d].name: must be set", errInvalidConfig, i)
+		case seen[section.Name]:
+			return nil, fmt.Errorf("%w: ups[%d].name: %w: %s", errInvalidConfig, i, errDuplicateUPS, section.Name)
+		case section.Source == "":
+			config.kind = c.sourceKind
+		}
+		seen[section.Name] = true
+
+		if section.CmdPath != "" {
+			config.source.cmdPath = section.CmdPath
+		}
+		if section.ExecTimeout < 0 {
+			return nil, fmt.Errorf("%w: ups[%d].exec_timeout: must not be negative", errInvalidConfig, i)
+		} else if section.ExecTimeout > 0 {
+			config.source.execTimeout = section.ExecTimeout
+		}
+		if section.Device != "" {
+			config.source.hidDevice = section.Device
+		}
+		if section.Addr != "" {
+			config.source.nutAddr = section.Addr
+		}
+		if section.NUTUPS != "" {
+			config.source.nutUPS = section.NUTUPS
+		}
+		if section.Replay != "" {
+			config.source.replayPath = section.Replay
+		}
+		if section.ReplaySpeed != nil {
+			config.source.replaySpeed = *section.ReplaySpeed
+		}
+		if section.Interval != nil {
+			if *section.Interval < 0 {
+				return nil, fmt.Errorf("%w: ups[%d].interval: must not be negative", errInvalidConfig, i)
+			}
+			config.minInterval = *section.Interval
+		}
+		if _, err := newSource(config.kind, config.source); err != nil {
+			return nil, fmt.Errorf("%w: ups[%d].source: %w", errInvalidConfig, i, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (c configFile) mqttConfig() mqttConfig {
+	return mqttConfig{
+		broker:          c.Outputs.MQTT.Broker,
+		clientID:        c.Outputs.MQTT.ClientID,
+		username:        c.Outputs.MQTT.Username,
+		password:        c.Outputs.MQTT.Password,
+		topicPrefix:     c.Outputs.MQTT.TopicPrefix,
+		discoveryPrefix: c.Outputs.MQTT.DiscoveryPrefix,
+	}
+}
+
+func (c configFile) influxConfig() influxConfig {
+	return influxConfig{
+		url:           c.Outputs.Influx.URL,
+		version:       c.Outputs.Influx.Version,
+		database:      c.Outputs.Influx.Database,
+		username:      c.Outputs.Influx.Username,
+		password:      c.Outputs.Influx.Password,
+		org:           c.Outputs.Influx.Org,
+		bucket:        c.Outputs.Influx.Bucket,
+		token:         c.Outputs.Influx.Token,
+		flushInterval: c.Outputs.Influx.FlushInterval,
+	}
+}
+
+// webhookConfig reads the webhook template file, if one is set.
+func (c configFile) webhookConfig() (webhookConfig, error) {
+	var config = webhookConfig{
+		urls:        c.Outputs.Webhooks.URLs,
+		template:    defaultWebhookTemplate,
+		contentType: c.Outputs.Webhooks.ContentType,
+		events:      c.Outputs.Webhooks.Events,
+		dedup:       c.Outputs.Webhooks.Dedup,
+		retries:     c.Outputs.Webhooks.Retries,
+		backoff:     time.Second,
+	}
+	if c.Outputs.Webhooks.TemplateFile != "" {
+		var tmpl, err = os.ReadFile(c.Outputs.Webhooks.TemplateFile)
+		if err != nil {
+			return webhookConfig{}, fmt.Errorf("unable to read webhook template, err: %w", err)
+		}
+		config.template = string(tmpl)
+	}
+	if _, err := parseWebhookTemplate(config.template); err != nil {
+		return webhookConfig{}, err
+	}
+	return config, nil
+}
+
+func (c configFile) shutdownPolicy() shutdownPolicy {
+	return shutdownPolicy{
+		batteryCapacity:  c.Alerts.Shutdown.BatteryCapacity,
+		remainingRuntime: c.Alerts.Shutdown.RemainingRuntime,
+		onBattery:        c.Alerts.Shutdown.OnBattery,
+		grace:            c.Alerts.Shutdown.Grace,
+		commands:         c.Alerts.Shutdown.Exec,
+		urls:             c.Alerts.Shutdown.URLs,
+		dryRun:           c.Alerts.Shutdown.DryRun,
+	}
+}
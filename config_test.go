@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// testFlagConfig is a configFile as the flag defaults fill it in.
+func testFlagConfig() configFile {
+	var config configFile
+	config.PollInterval = 5 * time.Second
+	config.Listen.Metrics = ":9300"
+	config.Alerts.LowBattery = 20
+	config.Alerts.Shutdown.Grace = time.Minute
+	config.Outputs.Webhooks.ContentType = "application/json"
+	config.Outputs.Webhooks.Events = strings.Split(defaultWebhookEvents, ",")
+	config.upsName, config.sourceKind = "cyberpower", "pwrstat"
+	config.sourceDefaults = sourceConfig{cmdPath: "/usr/sbin/pwrstat", nutAddr: "localhost:3493"}
+	return config
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	var path = filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigFileExample(t *testing.T) {
+	t.Parallel()
+
+	var config, err = loadConfigFile("cyberpower_exporter.example.yml", testFlagConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, 0.15, config.EnergyPricePerKWh)
+	assert.Equal(t, ":3493", config.Listen.NUT.Addr)
+	assert.Equal(t, 2, config.Outputs.Influx.Version)
+	assert.Equal(t, []string{"systemctl poweroff"}, config.Alerts.Shutdown.Exec)
+	assert.Equal(t, 5*time.Minute, config.shutdownPolicy().remainingRuntime)
+
+	upsConfigs, err := config.upsConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, []upsConfig{
+		{name: "rack1", kind: "pwrstat", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", execTimeout: 10 * time.Second, recordDir: "/var/lib/cyberpower_exporter/captures/rack1", recordKeep: 1000, nutAddr: "localhost:3493"}, minInterval: 5 * time.Second},
+		{name: "rack2", kind: "hid", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", recordDir: "/var/lib/cyberpower_exporter/captures/rack2", recordKeep: 1000, hidDevice: "/dev/hidraw0", nutAddr: "localhost:3493"}, minInterval: 10 * time.Second},
+		{name: "closet", kind: "nut", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", recordDir: "/var/lib/cyberpower_exporter/captures/closet", recordKeep: 1000, nutAddr: "10.0.0.2:3493", nutUPS: "cp1500"}, minInterval: 5 * time.Second},
+	}, upsConfigs)
+}
+
+func TestLoadConfigFileKeepsFlags(t *testing.T) {
+	t.Parallel()
+
+	var base = testFlagConfig()
+	base.upsFlags = stringsFlag{"rack1=nut"}
+	base.Outputs.MQTT.Broker = "tcp://mqtt:1883"
+
+	var config, err = loadConfigFile(writeConfigFile(t, "poll_interval: 1m\n"), base)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://mqtt:1883", config.Outputs.MQTT.Broker)
+	assert.Equal(t, ":9300", config.Listen.Metrics)
+
+	// -ups is used when the file lists no ups, with the file's poll_interval
+	upsConfigs, err := config.upsConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, []upsConfig{{name: "rack1", kind: "nut", source: base.sourceDefaults, minInterval: time.Minute}}, upsConfigs)
+
+	// an empty file is fine too
+	_, err = loadConfigFile(writeConfigFile(t, ""), base)
+	assert.NoError(t, err)
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	t.Parallel()
+
+	for content, expected := range map[string]string{
+		"poll_intervall: 5s\n":                                              "line 1: field poll_intervall not found",
+		"listen:\n  metrics: :9300\n  nut:\n    adr: x\n":                   "line 4: field adr not found",
+		"poll_interval: soon\n":                                             "line 1: cannot unmarshal !!str `soon` into time.Duration",
+		"ups:\n  - name: a\n  - name: a\n":                                  "ups[1].name: duplicate ups name: a",
+		"ups:\n  - name: a\n  - name: b\n    source: usb\n":                 `ups[1].source: unknown source: usb`,
+		"ups:\n  - source: nut\n":                                           "ups[0].name: must be set",
+		"alerts:\n  low_battery: 120\n":                                     "alerts.low_battery: must be between 0 and 100",
+		"alerts:\n  shutdown:\n    battery_capacity: 10\n":                  "alerts.shutdown: a shutdown threshold is set",
+		"outputs:\n  webhooks:\n    events: [on_fire]\n":                    `outputs.webhooks.events[0]: unknown event "on_fire"`,
+		"outputs:\n  influx:\n    url: x\n    version: 3\n":                 "outputs.influx: unsupported influxdb api version 3",
+		"listen:\n  web_config_file: /nonexistent/web.yml\n":                "listen.web_config_file:",
+		"record:\n  keep: -1\n":                                             "record.keep: must not be negative",
+		"ups:\n  - name: a\n    source: replay\n    replay: /nonexistent\n": "ups[0].source: unable to read captures",
+	} {
+		var _, err = loadConfigFile(writeConfigFile(t, content), testFlagConfig())
+		assert.ErrorIs(t, err, errInvalidConfig, content)
+		assert.ErrorContains(t, err, expected, content)
+	}
+
+	var _, err = loadConfigFile(filepath.Join(t.TempDir(), "missing.yml"), testFlagConfig())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// testSchema is the part of JSON Schema cyberpower_exporter.schema.json uses.
+type testSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            int                    `json:"minLength"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Properties           map[string]*testSchema `json:"properties"`
+	Items                *testSchema            `json:"items"`
+	Defs                 map[string]*testSchema `json:"$defs"`
+}
+
+func loadTestSchema(t *testing.T) *testSchema {
+	t.Helper()
+
+	var data, err = os.ReadFile("cyberpower_exporter.schema.json")
+	assert.NoError(t, err)
+	var schema testSchema
+	assert.NoError(t, json.Unmarshal(data, &schema))
+	return &schema
+}
+
+// resolve follows a $ref into $defs.
+func (s *testSchema) resolve(root *testSchema) *testSchema {
+	if name, ok := strings.CutPrefix(s.Ref, "#/$defs/"); ok {
+		return root.Defs[name]
+	}
+	return s
+}
+
+// kind is the JSON type of the schema, enums are the type of their values.
+func (s *testSchema) kind() string {
+	if s.Type != "" || len(s.Enum) == 0 {
+		return s.Type
+	}
+	if _, ok := s.Enum[0].(string); ok {
+		return "string"
+	}
+	return "integer"
+}
+
+// checkSchemaType reports where the schema and the yaml tags of typ differ.
+func checkSchemaType(t *testing.T, root, schema *testSchema, typ reflect.Type, path string) {
+	t.Helper()
+
+	if !assert.NotNil(t, schema, path+": not in the schema") {
+		return
+	}
+	if schema = schema.resolve(root); !assert.NotNil(t, schema, path+": unknown $ref") {
+		return
+	}
+	if typ == reflect.TypeFor[time.Duration]() {
+		assert.Same(t, root.Defs["duration"], schema, path)
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Pointer:
+		checkSchemaType(t, root, schema, typ.Elem(), path)
+	case reflect.Slice:
+		if assert.Equal(t, "array", schema.kind(), path) {
+			checkSchemaType(t, root, schema.Items, typ.Elem(), path+"[]")
+		}
+	case reflect.Struct:
+		assert.Equal(t, "object", schema.kind(), path)
+		if assert.NotNil(t, schema.AdditionalProperties, path) {
+			assert.False(t, *schema.AdditionalProperties, path)
+		}
+		var keys []string
+		for i := range typ.NumField() {
+			var field = typ.Field(i)
+			var key, _, _ = strings.Cut(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || key == "" {
+				continue
+			}
+			keys = append(keys, key)
+			checkSchemaType(t, root, schema.Properties[key], field.Type, strings.TrimPrefix(path+"."+key, "."))
+		}
+		assert.ElementsMatch(t, keys, slices.Collect(maps.Keys(schema.Properties)), path)
+	case reflect.String:
+		assert.Equal(t, "string", schema.kind(), path)
+	case reflect.Int:
+		assert.Equal(t, "integer", schema.kind(), path)
+	case reflect.Float64:
+		assert.Equal(t, "number", schema.kind(), path)
+	case reflect.Bool:
+		assert.Equal(t, "boolean", schema.kind(), path)
+	default:
+		t.Errorf("%s: no schema check for %s", path, typ)
+	}
+}
+
+// schemaErrors validates a decoded YAML value against schema.
+func schemaErrors(root, schema *testSchema, value any, path string) []string {
+	schema = schema.resolve(root)
+	if number, ok := value.(int); ok {
+		value = float64(number)
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+		return []string{fmt.Sprintf("%s: %v is not one of %v", path, value, schema.Enum)}
+	}
+
+	var errs []string
+	switch schema.kind() {
+	case "object":
+		var object, ok = value.(map[string]any)
+		if !ok {
+			return []string{path + ": not an object"}
+		}
+		for _, key := range schema.Required {
+			if _, ok := object[key]; !ok {
+				errs = append(errs, path+"."+key+": required")
+			}
+		}
+		for key, val := range object {
+			var property, ok = schema.Properties[key]
+			if !ok {
+				errs = append(errs, path+"."+key+": not allowed")
+				continue
+			}
+			errs = append(errs, schemaErrors(root, property, val, path+"."+key)...)
+		}
+	case "array":
+		var array, ok = value.([]any)
+		if !ok {
+			return []string{path + ": not an array"}
+		}
+		for i, val := range array {
+			errs = append(errs, schemaErrors(root, schema.Items, val, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		var str, ok = value.(string)
+		switch {
+		case !ok:
+			errs = append(errs, path+": not a string")
+		case len(str) < schema.MinLength:
+			errs = append(errs, path+": too short")
+		case schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).MatchString(str):
+			errs = append(errs, fmt.Sprintf("%s: %q does not match %s", path, str, schema.Pattern))
+		}
+	case "integer", "number":
+		var number, ok = value.(float64)
+		switch {
+		case !ok || (schema.kind() == "integer" && number != float64(int(number))):
+			errs = append(errs, path+": not an "+schema.kind())
+		case schema.Minimum != nil && number < *schema.Minimum, schema.Maximum != nil && number > *schema.Maximum:
+			errs = append(errs, path+": out of range")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, path+": not a boolean")
+		}
+	}
+	return errs
+}
+
+func TestConfigSchema(t *testing.T) {
+	t.Parallel()
+
+	var schema = loadTestSchema(t)
+	checkSchemaType(t, schema, schema, reflect.TypeFor[configFile](), "")
+	assert.ElementsMatch(t, knownEvents, schema.Defs["event"].Enum)
+
+	var data, err = os.ReadFile("cyberpower_exporter.example.yml")
+	assert.NoError(t, err)
+	var example any
+	assert.NoError(t, yaml.Unmarshal(data, &example))
+	assert.Empty(t, schemaErrors(schema, schema, example, ""))
+
+	for content, expected := range map[string]string{
+		"poll_intervall: 5s\n":                           ".poll_intervall: not allowed",
+		"poll_interval: soon\n":                          `.poll_interval: "soon" does not match`,
+		"ups:\n  - source: nut\n":                        ".ups[0].name: required",
+		"ups:\n  - name: a\n    source: usb\n":           ".ups[0].source: usb is not one of",
+		"alerts:\n  low_battery: 120\n":                  ".alerts.low_battery: out of range",
+		"outputs:\n  webhooks:\n    events: [on_fire]\n": ".outputs.webhooks.events[0]: on_fire is not one of",
+	} {
+		var config any
+		assert.NoError(t, yaml.Unmarshal([]byte(content), &config))
+		var errs = schemaErrors(schema, schema, config, "")
+		if assert.Len(t, errs, 1, content) {
+			assert.Contains(t, errs[0], expected, content)
+		}
+	}
+}
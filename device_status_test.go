@@ -120,7 +120,7 @@ func TestGetTestResult(t *testing.T) {
 	var result, date, err = getTestResult(testOutputNormal)
 	assert.NoError(t, err)
 	assert.Equal(t, "Passed", result)
-	assert.Equal(t, time.Date(2023, time.March, 9, 13, 25, 33, 0, time.UTC), date)
+	assert.Equal(t, time.Date(2023, time.March, 9, 13, 25, 33, 0, testLocation), date)
 
 	/* getDeviceInfoAsString needs to return a slice in order to test this
 	result, date, err = getTestResult("Test Result.................. Passed at \n") // missing date string
@@ -136,6 +136,11 @@ func TestGetTestResult(t *testing.T) {
 	assert.Empty(t, result)
 	assert.Equal(t, time.Time{}, date)
 
+	result, date, err = getTestResult("Test Result.................. In progress\n") // test running, no date
+	assert.NoError(t, err)
+	assert.Equal(t, "In progress", result)
+	assert.Equal(t, time.Time{}, date)
+
 	result, date, err = getTestResult("testOutputNormal") // bad string
 	assert.Error(t, err)
 	assert.Equal(t, "unable to find the last test result, err: could not find any matches", err.Error())
@@ -149,7 +154,7 @@ func TestGetLastPowerEvent(t *testing.T) {
 	var result, date, duration, err = getLastPowerEvent(testOutputNormal)
 	assert.NoError(t, err)
 	assert.Equal(t, "Blackout", result)
-	assert.Equal(t, time.Date(2023, time.March, 9, 12, 55, 9, 0, time.UTC), date)
+	assert.Equal(t, time.Date(2023, time.March, 9, 12, 55, 9, 0, testLocation), date)
 	assert.Equal(t, time.Duration(3000000000), duration)
 
 	result, date, duration, err = getLastPowerEvent("Last Power Event............. None\n") // no power event
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The UPS state transitions an eventDetector reports.
+const (
+	eventPowerFailure          = "power_failure"
+	eventPowerRestored         = "power_restored"
+	eventOnBattery             = "on_battery"
+	eventOnUtility             = "on_utility"
+	eventCommunicationLost     = "communication_lost"
+	eventCommunicationRestored = "communication_restored"
+	eventSelfTestFailed        = "self_test_failed"
+	eventLowBattery            = "low_battery"
+)
+
+// upsEvent is a state transition of a UPS.
+type upsEvent struct {
+	name     string
+	ups      string
+	time     time.Time
+	device   Device
+	status   DeviceStatus
+	previous DeviceStatus
+}
+
+// eventDetector compares consecutive readings of each UPS and hands the
+// transitions between them to its handlers.
+type eventDetector struct {
+	handlers []func(upsEvent)
+
+	mu         sync.Mutex
+	lowBattery int // battery capacity % at or below which low_battery fires
+	previous   map[string]DeviceStatus
+}
+
+func newEventDetector(lowBattery int) *eventDetector {
+	return &eventDetector{lowBattery: lowBattery, previous: map[string]DeviceStatus{}}
+}
+
+// handle registers fn to be called with every event, it must be registered
+// before the detector observes readings and must not block.
+func (d *eventDetector) handle(fn func(upsEvent)) {
+	d.handlers = append(d.handlers, fn)
+}
+
+// setLowBattery changes the battery capacity % low_battery fires at.
+func (d *eventDetector) setLowBattery(lowBattery int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lowBattery = lowBattery
+}
+
+// observe is a upsMonitor observer. Failed reads are skipped, the next good
+// reading is compared with the last good one.
+func (d *eventDetector) observe(reading upsReading) {
+	if reading.err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	var previous, seen = d.previous[reading.ups]
+	d.previous[reading.ups] = reading.status
+	var lowBattery = d.lowBattery
+	d.mu.Unlock()
+
+	// the first reading is the baseline
+	if !seen {
+		return
+	}
+
+	// a source that does not stamp its readings still gets events with a time
+	var at = reading.status.CollectionTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	for _, name := range detectEvents(previous, reading.status, lowBattery) {
+		var event = upsEvent{
+			name:     name,
+			ups:      reading.ups,
+			time:     at,
+			device:   reading.device,
+			status:   reading.status,
+			previous: previous,
+		}
+		for _, fn := range d.handlers {
+			fn(event)
+		}
+	}
+}
+
+// detectEvents returns the events between two consecutive readings.
+func detectEvents(previous, current DeviceStatus, lowBattery int) []string {
+	var wasLost, isLost = previous.State == "Lost Communication", current.State == "Lost Communication"
+	switch {
+	case !wasLost && isLost:
+		return []string{eventCommunicationLost}
+	case wasLost && isLost:
+		return nil
+	case wasLost:
+		// nothing else is known about the previous reading
+		return []string{eventCommunicationRestored}
+	}
+
+	var events []string
+	if previous.State != "Power Failure" && current.State == "Power Failure" {
+		events = append(events, eventPowerFailure)
+	}
+	if previous.State == "Power Failure" && current.State == "Normal" {
+		events = append(events, eventPowerRestored)
+	}
+	if previous.PowerSupplyBy != "Battery Power" && current.PowerSupplyBy == "Battery Power" {
+		events = append(events, eventOnBattery)
+	}
+	if previous.PowerSupplyBy == "Battery Power" && current.PowerSupplyBy == "Utility Power" {
+		events = append(events, eventOnUtility)
+	}
+	if selfTestFailed(current.TestResult) &&
+		(previous.TestResult != current.TestResult || !previous.TestResultTime.Equal(current.TestResultTime)) {
+		events = append(events, eventSelfTestFailed)
+	}
+	if previous.BatteryCapacity > lowBattery && current.BatteryCapacity <= lowBattery {
+		events = append(events, eventLowBattery)
+	}
+	return events
+}
+
+// selfTestFailed reports whether a test result is a failure.
+func selfTestFailed(result string) bool {
+	switch result {
+	case "Failed", "Error", "Warning":
+		return true
+	default:
+		return false
+	}
+}
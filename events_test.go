@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectEvents(t *testing.T) {
+	t.Parallel()
+
+	var normal, err = parsePowerStatus(testOutputNormal)
+	assert.NoError(t, err)
+	blackout, err := parsePowerStatus(testOutputBlackout)
+	assert.NoError(t, err)
+	lost, err := parsePowerStatus(testLostConnection)
+	assert.NoError(t, err)
+	assert.False(t, lost.CollectionTime.IsZero())
+
+	assert.Empty(t, detectEvents(normal, normal, 40))
+	assert.Equal(t, []string{eventPowerFailure, eventOnBattery, eventLowBattery}, detectEvents(normal, blackout, 40))
+	assert.Equal(t, []string{eventPowerFailure, eventOnBattery}, detectEvents(normal, blackout, 20))
+	assert.Equal(t, []string{eventPowerRestored, eventOnUtility}, detectEvents(blackout, normal, 40))
+	assert.Equal(t, []string{eventCommunicationLost}, detectEvents(blackout, lost, 40))
+	assert.Empty(t, detectEvents(lost, lost, 40))
+	assert.Equal(t, []string{eventCommunicationRestored}, detectEvents(lost, normal, 40))
+
+	// a failed test fires once, and again for the next failed test
+	var failed = normal
+	failed.TestResult = "Failed"
+	assert.Equal(t, []string{eventSelfTestFailed}, detectEvents(normal, failed, 40))
+	assert.Empty(t, detectEvents(failed, failed, 40))
+	var failedAgain = failed
+	failedAgain.TestResultTime = failed.TestResultTime.Add(24 * time.Hour)
+	assert.Equal(t, []string{eventSelfTestFailed}, detectEvents(failed, failedAgain, 40))
+}
+
+func TestEventDetector(t *testing.T) {
+	t.Parallel()
+
+	var detector = newEventDetector(20)
+	var events []upsEvent
+	detector.handle(func(event upsEvent) { events = append(events, event) })
+
+	var source = fakePwrstatSource(testOutputNormal, nil)
+	var monitor = newUPSMonitor("rack1", source, 0)
+	monitor.observe(detector.observe)
+
+	// the first reading is only a baseline, failed reads are skipped
+	monitor.update()
+	source.getStats = func(context.Context, string) (string, error) { return "", errors.New("pwrstatd is not running") }
+	monitor.update()
+	assert.Empty(t, events)
+
+	source.getStats = func(context.Context, string) (string, error) { return testOutputBlackout, nil }
+	monitor.update()
+
+	var names = make([]string, 0, len(events))
+	for _, event := range events {
+		assert.Equal(t, "rack1", event.ups)
+		assert.Equal(t, "Battery Power", event.status.PowerSupplyBy)
+		assert.Equal(t, "Utility Power", event.previous.PowerSupplyBy)
+		assert.Equal(t, "CP1500PFCLCDa", event.device.ModelName)
+		names = append(names, event.name)
+	}
+	assert.Equal(t, []string{eventPowerFailure, eventOnBattery}, names)
+
+	// losing the UPS is an event with a time as well
+	source.getStats = func(context.Context, string) (string, error) { return testLostConnection, nil }
+	monitor.update()
+	assert.Len(t, events, 3)
+	assert.Equal(t, eventCommunicationLost, events[2].name)
+	assert.False(t, events[2].time.IsZero())
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroupOnCancel leaves cmd as is, without process groups only the
+// command itself is killed when its context is done.
+func killProcessGroupOnCancel(*exec.Cmd) {}
@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPwrstatSourceTimeout(t *testing.T) {
+	t.Parallel()
+
+	// a wedged pwrstat that has a child of its own
+	var dir = t.TempDir()
+	var pidFile = filepath.Join(dir, "child.pid")
+	var script = filepath.Join(dir, "pwrstat")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nsleep 30 &\necho $! > "+pidFile+"\nwait\n"), 0o700))
+
+	var source = newPwrstatSource(script, 200*time.Millisecond)
+	var start = time.Now()
+	var _, _, err = source.Fetch(context.Background())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	var sErr *scrapeError
+	assert.ErrorAs(t, err, &sErr)
+	assert.Equal(t, stageExecTimeout, sErr.stage)
+	assert.ErrorIs(t, err, errPwrstatTimeout)
+
+	// the whole process group is killed
+	pid, err := os.ReadFile(pidFile)
+	assert.NoError(t, err)
+	child, err := strconv.Atoi(strings.TrimSpace(string(pid)))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return syscall.Kill(child, 0) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildFakePwrstat builds cmd/fake-pwrstat and returns a script that runs it
+// with scenario, so it can be used as -cmd-path.
+func buildFakePwrstat(t *testing.T, scenario string) string {
+	t.Helper()
+
+	var dir = t.TempDir()
+	var bin = filepath.Join(dir, "fake-pwrstat")
+	var out, err = exec.Command("go", "build", "-o", bin, "./cmd/fake-pwrstat").CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	var scenarioFile = filepath.Join(dir, "scenario.yml")
+	assert.NoError(t, os.WriteFile(scenarioFile, []byte(scenario), 0o600))
+	var script = filepath.Join(dir, "pwrstat")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nexec "+bin+" -scenario "+scenarioFile+" \"$@\"\n"), 0o700))
+	return script
+}
+
+func TestFakePwrstatEndToEnd(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("builds cmd/fake-pwrstat")
+	}
+
+	var cmdPath = buildFakePwrstat(t, `
+steps:
+  - calls: 1
+    battery_capacity: 100
+  - calls: 3
+    state: Power Failure
+    power_supply: Battery Power
+    utility_voltage: 0
+    battery_capacity_end: 15
+    remaining_runtime_end: 4m
+  - calls: 1
+    state: Lost Communication
+  - calls: 1
+    exit_status: 1
+    stderr: Cannot connect to daemon
+  - calls: 1
+    state: Normal
+    power_supply: Utility Power
+    utility_voltage: 122
+    test_result: In progress
+    test_result_time: ""
+`)
+
+	var monitor = newUPSMonitor("rack1", newPwrstatSource(cmdPath, 5*time.Second), 10*time.Millisecond)
+	var events = newEventDetector(20)
+	var mu sync.Mutex
+	var names []string
+	events.handle(func(event upsEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		names = append(names, event.name)
+	})
+	var readings = make(chan upsReading, 100)
+	monitor.observe(events.observe)
+	monitor.observe(func(reading upsReading) { readings <- reading })
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	go monitor.poll(ctx)
+	for range 7 {
+		select {
+		case <-readings:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the poll loop")
+		}
+	}
+	cancel()
+
+	mu.Lock()
+	assert.Equal(t, []string{eventPowerFailure, eventOnBattery, eventLowBattery, eventCommunicationLost, eventCommunicationRestored}, names)
+	mu.Unlock()
+
+	var registry = prometheus.NewRegistry()
+	registry.MustRegister(NewUPSCollector(monitor))
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	newStatusAPI([]*upsMonitor{monitor}).register(mux)
+	var server = httptest.NewServer(mux)
+	defer server.Close()
+
+	var status map[string]any
+	assert.Equal(t, http.StatusOK, getJSON(t, mux, "/api/v1/status/rack1", &status))
+	assert.Equal(t, "Normal", status["state"])
+	assert.Equal(t, "In progress", status["test_result"])
+	assert.Equal(t, float64(15), status["battery_capacity"])
+	assert.Equal(t, float64(240), status["remaining_runtime_seconds"])
+
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Contains(t, string(body), `cyber_power_exporter_test_result_state{result="In progress",ups="rack1"} 1`)
+	assert.Contains(t, string(body), `cyber_power_exporter_scrape_errors_total{getter="getPowerStats",stage="exec",ups="rack1"} 1`)
+	assert.Contains(t, string(body), `cyber_power_exporter_communication_lost{ups="rack1"} 0`)
+	assert.Contains(t, string(body), `cyber_power_exporter_up{ups="rack1"} 1`)
+}
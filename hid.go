@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	errHIDFieldNotFound     = errors.New("usage not found in report descriptor")
+	errHIDDescriptorInvalid = errors.New("invalid report descriptor")
+	errHIDReportTooShort    = errors.New("feature report is shorter than expected")
+)
+
+// HID usages (page << 16 | id) from the USB HID Power Device Class spec.
+const (
+	hidUsageInput               = 0x0084_001A
+	hidUsageOutput              = 0x0084_001C
+	hidUsageVoltage             = 0x0084_0030
+	hidUsageActivePower         = 0x0084_0034
+	hidUsagePercentLoad         = 0x0084_0035
+	hidUsageConfigVoltage       = 0x0084_0040
+	hidUsageConfigApparentPower = 0x0084_0043
+	hidUsageConfigActivePower   = 0x0084_0044
+	hidUsageTest                = 0x0084_0058
+	hidUsageBoost               = 0x0084_006E
+	hidUsageBuck                = 0x0084_006F
+	hidUsageRemainingCapacity   = 0x0085_0066
+	hidUsageRunTimeToEmpty      = 0x0085_0068
+	hidUsageACPresent           = 0x0085_00D0
+)
+
+// HID units of the SI linear system the exporter scales, they are in cgs so a
+// volt or watt is 10^7 of the unit.
+const (
+	hidUnitVolt = 0x00F0_D121 // g cm^2 s^-3 A^-1
+	hidUnitWatt = 0x0000_D121 // g cm^2 s^-3, also used for VA
+)
+
+// hidTestResults maps the Test usage value onto the strings pwrstat prints.
+// nolint: gochecknoglobals
+var hidTestResults = map[int64]string{
+	1: "Passed",
+	2: "Warning",
+	3: "Error",
+	4: "Aborted",
+	5: "In progress",
+	6: "None",
+}
+
+// hidDevice is the subset of a hidraw device the HID backend needs. It is an
+// interface so tests can feed recorded descriptors and reports. FeatureReport
+// returns the report body without the leading report id.
+type hidDevice interface {
+	Name() (string, error)
+	ReportDescriptor() ([]byte, error)
+	FeatureReport(reportID byte, size int) ([]byte, error)
+	Close() error
+}
+
+// hidField is a single value in a feature report.
+type hidField struct {
+	usage       uint32 // page << 16 | id
+	collections []uint32
+	reportID    byte
+	bitOffset   int
+	bitSize     int
+	signed      bool
+	unit        uint32
+	exponent    int // unit exponent, the value is the logical one * 10^exponent
+}
+
+// hidDescriptor is the parsed form of a report descriptor, only feature
+// reports are kept as that is how Power Device Class UPSs expose state.
+type hidDescriptor struct {
+	fields     []hidField
+	reportBits map[byte]int
+}
+
+// hidSource reads a UPS directly over USB HID instead of running pwrstat.
+type hidSource struct {
+	path string
+	open func(path string) (hidDevice, error)
+}
+
+func newHIDSource(path string) *hidSource {
+	return &hidSource{path: path, open: openHIDDevice}
+}
+
+func (s *hidSource) Fetch(_ context.Context) (Device, DeviceStatus, error) {
+	var dev, err = s.open(s.path)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "openHIDDevice", err: err}
+	}
+	defer func() { _ = dev.Close() }()
+
+	rawDesc, err := dev.ReportDescriptor()
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "ReportDescriptor", err: err}
+	}
+
+	desc, err := parseHIDDescriptor(rawDesc)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseDevice, getter: "parseHIDDescriptor", err: err}
+	}
+
+	var reports = hidReports{dev: dev, desc: desc, cache: map[byte][]byte{}}
+
+	device, err := reports.device()
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseDevice, getter: failedGetter(err), err: err}
+	}
+
+	status, err := reports.status(device)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseStatus, getter: failedGetter(err), err: err}
+	}
+
+	return device, status, nil
+}
+
+// hidReports reads feature reports on demand, each report is read at most once.
+type hidReports struct {
+	dev   hidDevice
+	desc  *hidDescriptor
+	cache map[byte][]byte
+}
+
+func (r *hidReports) device() (Device, error) {
+	var device = Device{}
+
+	var name, err = r.dev.Name()
+	if err != nil {
+		return Device{}, &getterError{getter: "getModelName", err: err}
+	}
+	// hidraw names are "<manufacturer> <product>", e.g. "CPS CP1500PFCLCD"
+	if fields := strings.Fields(name); len(fields) > 0 {
+		device.ModelName = fields[len(fields)-1]
+	}
+
+	ratingVoltage, err := r.value(hidUsageConfigVoltage)
+	if err != nil {
+		return Device{}, &getterError{getter: "getRatingVoltage", err: err}
+	}
+	device.RatingVoltage = int(ratingVoltage)
+
+	watts, err := r.value(hidUsageConfigActivePower)
+	if err != nil {
+		return Device{}, &getterError{getter: "getRatingPowerWatts", err: err}
+	}
+	device.RatingPowerWatts = int(watts)
+
+	// not all units report VA, it is informational only
+	if va, err := r.value(hidUsageConfigApparentPower); err == nil {
+		device.RatingPowerVA = int(va)
+	}
+
+	return device, nil
+}
+
+func (r *hidReports) status(device Device) (DeviceStatus, error) {
+	var status = DeviceStatus{}
+
+	acPresent, err := r.value(hidUsageACPresent)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getPowerSupply", err: err}
+	}
+	if acPresent == 1 {
+		status.State = "Normal"
+		status.PowerSupplyBy = "Utility Power"
+	} else {
+		status.State = "Power Failure"
+		status.PowerSupplyBy = "Battery Power"
+	}
+
+	utilityVoltage, err := r.value(hidUsageVoltage, hidUsageInput)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getUtilityVoltage", err: err}
+	}
+	status.UtilityVoltage = int(utilityVoltage)
+
+	outputVoltage, err := r.value(hidUsageVoltage, hidUsageOutput)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getOutputVoltage", err: err}
+	}
+	status.OutputVoltage = int(outputVoltage)
+
+	capacity, err := r.value(hidUsageRemainingCapacity)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getBatteryCapacity", err: err}
+	}
+	status.BatteryCapacity = int(capacity)
+
+	runtime, err := r.value(hidUsageRunTimeToEmpty)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getRemainingRuntime", err: err}
+	}
+	// pwrstat only reports whole minutes, match it so backends are comparable
+	status.RemainingRuntime = (time.Duration(runtime) * time.Second).Truncate(time.Minute)
+
+	loadPct, err := r.value(hidUsagePercentLoad)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getLoad", err: err}
+	}
+	status.LoadPct = int(loadPct)
+	if watts, err := r.value(hidUsageActivePower); err == nil {
+		status.LoadWatts = int(watts)
+	} else {
+		status.LoadWatts = status.LoadPct * device.RatingPowerWatts / 100
+	}
+
+	status.LineInteraction = "None"
+	if boost, err := r.value(hidUsageBoost); err == nil && boost == 1 {
+		status.LineInteraction = "Boost"
+	}
+	if buck, err := r.value(hidUsageBuck); err == nil && buck == 1 {
+		status.LineInteraction = "Buck"
+	}
+
+	test, err := r.value(hidUsageTest)
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getTestResult", err: err}
+	}
+	status.TestResult = hidTestResults[test]
+	if status.TestResult == "" {
+		status.TestResult = fmt.Sprintf("Unknown(%d)", test)
+	}
+
+	// the HID spec has no power event log, that is kept by pwrstatd
+	status.LastPowerEvent = "None"
+	status.CollectionTime = time.Now()
+
+	return status, nil
+}
+
+// value reads the first field with the given usage. If collection is given the
+// field must be nested inside a collection with that usage.
+func (r *hidReports) value(usage uint32, collection ...uint32) (int64, error) {
+	var field, ok = r.desc.find(usage, collection...)
+	if !ok {
+		return 0, fmt.Errorf("%w: 0x%08x", errHIDFieldNotFound, usage)
+	}
+
+	report, ok := r.cache[field.reportID]
+	if !ok {
+		var err error
+		report, err = r.dev.FeatureReport(field.reportID, (r.desc.reportBits[field.reportID]+7)/8)
+		if err != nil {
+			return 0, fmt.Errorf("unable to read feature report %d, err: %w", field.reportID, err)
+		}
+		r.cache[field.reportID] = report
+	}
+
+	raw, err := field.extract(report)
+	if err != nil {
+		return 0, err
+	}
+	return field.scale(raw), nil
+}
+
+func (d *hidDescriptor) find(usage uint32, collection ...uint32) (hidField, bool) {
+	for _, field := range d.fields {
+		if field.usage != usage {
+			continue
+		}
+		if len(collection) == 0 {
+			return field, true
+		}
+		for _, c := range field.collections {
+			if c == collection[0] {
+				return field, true
+			}
+		}
+	}
+	return hidField{}, false
+}
+
+// extract pulls the field's bits out of a little endian report body.
+func (f hidField) extract(report []byte) (int64, error) {
+	if (f.bitOffset+f.bitSize+7)/8 > len(report) {
+		return 0, fmt.Errorf("%w: need %d bits at offset %d, have %d bytes", errHIDReportTooShort, f.bitSize, f.bitOffset, len(report))
+	}
+
+	var raw uint64
+	for i := range f.bitSize {
+		var bit = f.bitOffset + i
+		if report[bit/8]&(1<<(bit%8)) != 0 {
+			raw |= 1 << i
+		}
+	}
+
+	if f.signed && f.bitSize > 0 && f.bitSize < 64 && raw&(1<<(f.bitSize-1)) != 0 {
+		raw |= ^uint64(0) << f.bitSize
+	}
+	return int64(raw), nil
+}
+
+// scale applies the unit exponent to a logical value, rounding to whole units.
+// Volts and watts are cgs units, an exponent of 7 makes them SI ones. Many
+// UPSs give the unit with the default exponent of 0 though and mean plain
+// volts and watts, that is left as is.
+func (f hidField) scale(raw int64) int64 {
+	var exponent = f.exponent
+	if (f.unit == hidUnitVolt || f.unit == hidUnitWatt) && exponent != 0 {
+		exponent -= 7
+	}
+	if exponent == 0 {
+		return raw
+	}
+	return int64(math.Round(float64(raw) * math.Pow10(exponent)))
+}
+
+// hidGlobals is the global item state of a report descriptor.
+type hidGlobals struct {
+	usagePage    uint32
+	logicalMin   int64
+	unitExponent int
+	unit         uint32
+	reportSize   int
+	reportCount  int
+	reportID     byte
+}
+
+// parseHIDDescriptor walks the short items of a report descriptor and records
+// every variable feature field along with the collections it is nested in.
+func parseHIDDescriptor(raw []byte) (*hidDescriptor, error) {
+	var desc = &hidDescriptor{reportBits: map[byte]int{}}
+	var globals hidGlobals
+	var stack []hidGlobals
+	var usages []uint32
+	var usageMin, usageMax uint32
+	var collections []uint32
+
+	for i := 0; i < len(raw); {
+		var prefix = raw[i]
+		i++
+
+		// long items are reserved and never used by UPSs, skip them
+		if prefix == 0xFE {
+			if i+1 >= len(raw) {
+				return nil, fmt.Errorf("%w: truncated long item", errHIDDescriptorInvalid)
+			}
+			i += 2 + int(raw[i])
+			continue
+		}
+
+		var size = int(prefix & 0x3)
+		if size == 3 {
+			size = 4
+		}
+		if i+size > len(raw) {
+			return nil, fmt.Errorf("%w: item 0x%02x at offset %d is truncated", errHIDDescriptorInvalid, prefix, i-1)
+		}
+
+		var data uint32
+		for b := range size {
+			data |= uint32(raw[i+b]) << (8 * b)
+		}
+		var signedData = int64(data)
+		if size > 0 && size < 4 && data&(1<<(8*size-1)) != 0 {
+			signedData -= 1 << (8 * size)
+		} else if size == 4 {
+			signedData = int64(int32(data))
+		}
+		i += size
+
+		var usage = func() uint32 {
+			if size == 4 {
+				return data
+			}
+			return globals.usagePage<<16 | data
+		}
+
+		switch prefix & 0xFC {
+		// main items
+		case 0x80, 0x90, 0xB0: // input, output, feature
+			var isFeature = prefix&0xFC == 0xB0
+			for n := range globals.reportCount {
+				var fieldUsage uint32
+				switch {
+				case n < len(usages):
+					fieldUsage = usages[n]
+				case len(usages) > 0:
+					fieldUsage = usages[len(usages)-1]
+				case usageMin != 0 && usageMin+uint32(n) <= usageMax:
+					fieldUsage = usageMin + uint32(n)
+				}
+
+				// constant fields are padding
+				if isFeature && data&0x1 == 0 && fieldUsage != 0 {
+					desc.fields = append(desc.fields, hidField{
+						usage:       fieldUsage,
+						collections: append([]uint32(nil), collections...),
+						reportID:    globals.reportID,
+						bitOffset:   desc.reportBits[globals.reportID],
+						bitSize:     globals.reportSize,
+						signed:      globals.logicalMin < 0,
+						unit:        globals.unit,
+						exponent:    globals.unitExponent,
+					})
+				}
+				if isFeature {
+					desc.reportBits[globals.reportID] += globals.reportSize
+				}
+			}
+			usages, usageMin, usageMax = nil, 0, 0
+		case 0xA0: // collection
+			var collectionUsage uint32
+			if len(usages) > 0 {
+				collectionUsage = usages[0]
+			}
+			collections = append(collections, collectionUsage)
+			usages, usageMin, usageMax = nil, 0, 0
+		case 0xC0: // end collection
+			if len(collections) == 0 {
+				return nil, fmt.Errorf("%w: unbalanced end collection", errHIDDescriptorInvalid)
+			}
+			collections = collections[:len(collections)-1]
+
+		// global items
+		case 0x04:
+			globals.usagePage = data
+		case 0x14:
+			globals.logicalMin = signedData
+		case 0x54:
+			// a 4 bit two's complement nibble, 0xF is -1
+			globals.unitExponent = int(data & 0xF)
+			if globals.unitExponent >= 8 {
+				globals.unitExponent -= 16
+			}
+		case 0x64:
+			globals.unit = data
+		case 0x74:
+			globals.reportSize = int(data)
+		case 0x84:
+			globals.reportID = byte(data)
+		case 0x94:
+			globals.reportCount = int(data)
+		case 0xA4: // push
+			stack = append(stack, globals)
+		case 0xB4: // pop
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%w: pop without push", errHIDDescriptorInvalid)
+			}
+			globals, stack = stack[len(stack)-1], stack[:len(stack)-1]
+
+		// local items
+		case 0x08:
+			usages = append(usages, usage())
+		case 0x18:
+			usageMin = usage()
+		case 0x28:
+			usageMax = usage()
+		}
+	}
+
+	if len(desc.fields) == 0 {
+		return nil, fmt.Errorf("%w: no feature fields found", errHIDDescriptorInvalid)
+	}
+
+	return desc, nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// hidraw ioctl requests, see linux/hidraw.h.
+const (
+	hidiocgrdescsize = 0x80044801
+	hidiocgrdesc     = 0x90044802
+	hidMaxDescSize   = 4096
+)
+
+func hidiocgrawname(size int) uintptr { return uintptr(0x80004804 | size<<16) }
+func hidiocgfeature(size int) uintptr { return uintptr(0xC0004807 | size<<16) }
+
+// hidrawDevice is a /dev/hidrawN node.
+type hidrawDevice struct {
+	file *os.File
+}
+
+func openHIDDevice(path string) (hidDevice, error) {
+	var file, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open hid device: %s, err: %w", path, err)
+	}
+	return &hidrawDevice{file: file}, nil
+}
+
+func (d *hidrawDevice) ioctl(req uintptr, arg unsafe.Pointer) (int, error) {
+	var n, _, errno = syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func (d *hidrawDevice) Name() (string, error) {
+	var buf = make([]byte, 256)
+	if _, err := d.ioctl(hidiocgrawname(len(buf)), unsafe.Pointer(&buf[0])); err != nil {
+		return "", fmt.Errorf("HIDIOCGRAWNAME failed, err: %w", err)
+	}
+	return string(bytes.TrimRight(buf, "\x00")), nil
+}
+
+func (d *hidrawDevice) ReportDescriptor() ([]byte, error) {
+	var size int32
+	if _, err := d.ioctl(hidiocgrdescsize, unsafe.Pointer(&size)); err != nil {
+		return nil, fmt.Errorf("HIDIOCGRDESCSIZE failed, err: %w", err)
+	}
+
+	var desc struct {
+		size  uint32
+		value [hidMaxDescSize]byte
+	}
+	desc.size = uint32(size)
+	if _, err := d.ioctl(hidiocgrdesc, unsafe.Pointer(&desc)); err != nil {
+		return nil, fmt.Errorf("HIDIOCGRDESC failed, err: %w", err)
+	}
+
+	return desc.value[:min(int(size), hidMaxDescSize)], nil
+}
+
+func (d *hidrawDevice) FeatureReport(reportID byte, size int) ([]byte, error) {
+	// the first byte is the report id on the way in and out
+	var buf = make([]byte, size+1)
+	buf[0] = reportID
+	var n, err = d.ioctl(hidiocgfeature(len(buf)), unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return nil, fmt.Errorf("HIDIOCGFEATURE failed for report %d, err: %w", reportID, err)
+	}
+	if n < 1 {
+		return nil, nil
+	}
+	return buf[1:n], nil
+}
+
+func (d *hidrawDevice) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+var errHIDUnsupported = errors.New("the hid backend is only supported on linux")
+
+func openHIDDevice(string) (hidDevice, error) {
+	return nil, errHIDUnsupported
+}
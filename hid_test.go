@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nolint: gochecknoglobals
+var (
+	// testHIDDescriptor is a trimmed down CP1500PFCLCD report descriptor, only
+	// the feature reports the exporter reads are kept.
+	testHIDDescriptor = []byte{
+		0x05, 0x84, // Usage Page (Power Device)
+		0x09, 0x04, // Usage (UPS)
+		0xA1, 0x01, // Collection (Application)
+		0x09, 0x24, //   Usage (Power Summary)
+		0xA1, 0x02, //   Collection (Logical)
+		0x85, 0x01, //     Report ID (1)
+		0x75, 0x08, //     Report Size (8)
+		0x95, 0x01, //     Report Count (1)
+		0x15, 0x00, //     Logical Minimum (0)
+		0x25, 0x64, //     Logical Maximum (100)
+		0x05, 0x85, //     Usage Page (Battery System)
+		0x09, 0x66, //     Usage (RemainingCapacity)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x85, 0x02, //     Report ID (2)
+		0x75, 0x10, //     Report Size (16)
+		0x27, 0xFF, 0xFF, 0x00, 0x00, // Logical Maximum (65535)
+		0x09, 0x68, //     Usage (RunTimeToEmpty)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x85, 0x03, //     Report ID (3)
+		0x75, 0x01, //     Report Size (1)
+		0x95, 0x03, //     Report Count (3)
+		0x25, 0x01, //     Logical Maximum (1)
+		0x09, 0xD0, //     Usage (ACPresent)
+		0x09, 0x44, //     Usage (Charging)
+		0x09, 0x45, //     Usage (Discharging)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x75, 0x05, //     Report Size (5)
+		0x95, 0x01, //     Report Count (1)
+		0xB1, 0x03, //     Feature (Const,Var,Abs)
+		0x05, 0x84, //     Usage Page (Power Device)
+		0x85, 0x04, //     Report ID (4)
+		0x75, 0x08, //     Report Size (8)
+		0x25, 0x06, //     Logical Maximum (6)
+		0x09, 0x58, //     Usage (Test)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x85, 0x05, //     Report ID (5)
+		0x25, 0x64, //     Logical Maximum (100)
+		0x09, 0x35, //     Usage (PercentLoad)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x85, 0x06, //     Report ID (6)
+		0x75, 0x01, //     Report Size (1)
+		0x95, 0x02, //     Report Count (2)
+		0x25, 0x01, //     Logical Maximum (1)
+		0x09, 0x6E, //     Usage (Boost)
+		0x09, 0x6F, //     Usage (Buck)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x75, 0x06, //     Report Size (6)
+		0x95, 0x01, //     Report Count (1)
+		0xB1, 0x03, //     Feature (Const,Var,Abs)
+		0x85, 0x07, //     Report ID (7)
+		0x75, 0x08, //     Report Size (8)
+		0x26, 0xFF, 0x00, // Logical Maximum (255)
+		0x09, 0x40, //     Usage (ConfigVoltage)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0x85, 0x08, //     Report ID (8)
+		0x75, 0x10, //     Report Size (16)
+		0x95, 0x02, //     Report Count (2)
+		0x27, 0xFF, 0xFF, 0x00, 0x00, // Logical Maximum (65535)
+		0x09, 0x44, //     Usage (ConfigActivePower)
+		0x09, 0x43, //     Usage (ConfigApparentPower)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0xC0,       //   End Collection
+		0x09, 0x1A, //   Usage (Input)
+		0xA1, 0x02, //   Collection (Logical)
+		0x85, 0x09, //     Report ID (9)
+		0x95, 0x01, //     Report Count (1)
+		0x09, 0x30, //     Usage (Voltage)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0xC0,       //   End Collection
+		0x09, 0x1C, //   Usage (Output)
+		0xA1, 0x02, //   Collection (Logical)
+		0x85, 0x0A, //     Report ID (10)
+		0x09, 0x30, //     Usage (Voltage)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0xC0, //   End Collection
+		0xC0, // End Collection
+	}
+
+	// testHIDDescriptorExponent gives the input voltage in decivolts and the
+	// rated power in tens of watts, the way some UPSs scale their reports.
+	testHIDDescriptorExponent = []byte{
+		0x05, 0x84, // Usage Page (Power Device)
+		0x09, 0x04, // Usage (UPS)
+		0xA1, 0x01, // Collection (Application)
+		0x09, 0x1A, //   Usage (Input)
+		0xA1, 0x02, //   Collection (Logical)
+		0x85, 0x01, //     Report ID (1)
+		0x75, 0x10, //     Report Size (16)
+		0x95, 0x01, //     Report Count (1)
+		0x15, 0x00, //     Logical Minimum (0)
+		0x27, 0xFF, 0xFF, 0x00, 0x00, // Logical Maximum (65535)
+		0x67, 0x21, 0xD1, 0xF0, 0x00, // Unit (Volt)
+		0x55, 0x06, //     Unit Exponent (6)
+		0x09, 0x30, //     Usage (Voltage)
+		0xB1, 0x02, //     Feature (Data,Var,Abs)
+		0xC0,       //   End Collection
+		0x85, 0x02, //   Report ID (2)
+		0x65, 0x00, //   Unit (None)
+		0x55, 0x01, //   Unit Exponent (1)
+		0x09, 0x44, //   Usage (ConfigActivePower)
+		0xB1, 0x02, //   Feature (Data,Var,Abs)
+		0x55, 0x0F, //   Unit Exponent (-1)
+		0x09, 0x35, //   Usage (PercentLoad)
+		0xB1, 0x02, //   Feature (Data,Var,Abs)
+		0xC0, // End Collection
+	}
+
+	// testHIDReportsNormal are the feature reports matching testOutputNormal.
+	testHIDReportsNormal = map[byte][]byte{
+		1:  {46},
+		2:  {0x90, 0x06}, // 1680 sec
+		3:  {0x03},       // ACPresent, Charging
+		4:  {1},          // Passed
+		5:  {12},
+		6:  {0x00},
+		7:  {120},
+		8:  {0xE8, 0x03, 0xDC, 0x05}, // 1000 W, 1500 VA
+		9:  {122, 0},
+		10: {122, 0},
+	}
+)
+
+type fakeHIDDevice struct {
+	name       string
+	descriptor []byte
+	reports    map[byte][]byte
+}
+
+func (d *fakeHIDDevice) Name() (string, error) {
+	return d.name, nil
+}
+
+func (d *fakeHIDDevice) ReportDescriptor() ([]byte, error) {
+	return d.descriptor, nil
+}
+
+func (d *fakeHIDDevice) FeatureReport(reportID byte, size int) ([]byte, error) {
+	var report, ok = d.reports[reportID]
+	if !ok {
+		return nil, errors.New("broken pipe")
+	}
+	return report[:min(size, len(report))], nil
+}
+
+func (d *fakeHIDDevice) Close() error {
+	return nil
+}
+
+func newFakeHIDSource(reports map[byte][]byte) *hidSource {
+	return &hidSource{
+		path: "/dev/hidraw0",
+		open: func(string) (hidDevice, error) {
+			return &fakeHIDDevice{name: "CPS CP1500PFCLCD", descriptor: testHIDDescriptor, reports: reports}, nil
+		},
+	}
+}
+
+func TestParseHIDDescriptor(t *testing.T) {
+	t.Parallel()
+
+	var desc, err = parseHIDDescriptor(testHIDDescriptor)
+	assert.NoError(t, err)
+	assert.Len(t, desc.fields, 14)
+	assert.Equal(t, 8, desc.reportBits[3])
+	assert.Equal(t, 32, desc.reportBits[8])
+
+	var field, ok = desc.find(hidUsageVoltage, hidUsageOutput)
+	assert.True(t, ok)
+	assert.Equal(t, byte(10), field.reportID)
+
+	field, ok = desc.find(hidUsageConfigApparentPower)
+	assert.True(t, ok)
+	assert.Equal(t, 16, field.bitOffset)
+	assert.Equal(t, 16, field.bitSize)
+
+	_, err = parseHIDDescriptor([]byte{0x05, 0x84, 0x27, 0xFF}) // truncated
+	assert.ErrorIs(t, err, errHIDDescriptorInvalid)
+
+	_, err = parseHIDDescriptor([]byte{0xC0}) // unbalanced
+	assert.ErrorIs(t, err, errHIDDescriptorInvalid)
+}
+
+func TestHIDFieldExtract(t *testing.T) {
+	t.Parallel()
+
+	var val, err = hidField{bitOffset: 2, bitSize: 1}.extract([]byte{0x04})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), val)
+
+	val, err = hidField{bitOffset: 0, bitSize: 8, signed: true}.extract([]byte{0xFE})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), val)
+
+	_, err = hidField{bitOffset: 8, bitSize: 16}.extract([]byte{0x01, 0x02})
+	assert.ErrorIs(t, err, errHIDReportTooShort)
+
+	val, err = hidField{bitOffset: 0, bitSize: 0, signed: true}.extract([]byte{0xFF})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), val)
+}
+
+func TestHIDUnitExponent(t *testing.T) {
+	t.Parallel()
+
+	var desc, err = parseHIDDescriptor(testHIDDescriptorExponent)
+	assert.NoError(t, err)
+
+	var field, ok = desc.find(hidUsageVoltage, hidUsageInput)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(hidUnitVolt), field.unit)
+	assert.Equal(t, 6, field.exponent)
+
+	field, ok = desc.find(hidUsagePercentLoad)
+	assert.True(t, ok)
+	assert.Equal(t, -1, field.exponent)
+
+	var reports = hidReports{
+		dev: &fakeHIDDevice{reports: map[byte][]byte{
+			1: {0xC5, 0x04},             // 1221 dV
+			2: {0x64, 0x00, 0x7B, 0x00}, // 100 * 10 W, 123 / 10 %
+		}},
+		desc:  desc,
+		cache: map[byte][]byte{},
+	}
+
+	val, err := reports.value(hidUsageVoltage, hidUsageInput)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(122), val)
+
+	val, err = reports.value(hidUsageConfigActivePower)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), val)
+
+	val, err = reports.value(hidUsagePercentLoad)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), val)
+}
+
+func TestHIDSourceNormal(t *testing.T) {
+	t.Parallel()
+
+	var device, status, err = newFakeHIDSource(testHIDReportsNormal).Fetch(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "CP1500PFCLCD", device.ModelName)
+	assert.Equal(t, 120, device.RatingVoltage)
+	assert.Equal(t, 1000, device.RatingPowerWatts)
+	assert.Equal(t, 1500, device.RatingPowerVA)
+
+	assert.Equal(t, "Normal", status.State)
+	assert.Equal(t, "Utility Power", status.PowerSupplyBy)
+	assert.Equal(t, 122, status.UtilityVoltage)
+	assert.Equal(t, 122, status.OutputVoltage)
+	assert.Equal(t, 46, status.BatteryCapacity)
+	assert.Equal(t, time.Duration(28)*time.Minute, status.RemainingRuntime)
+	assert.Equal(t, 120, status.LoadWatts)
+	assert.Equal(t, 12, status.LoadPct)
+	assert.Equal(t, "None", status.LineInteraction)
+	assert.Equal(t, "Passed", status.TestResult)
+}
+
+func TestHIDSourceBlackout(t *testing.T) {
+	t.Parallel()
+
+	var reports = map[byte][]byte{}
+	for id, report := range testHIDReportsNormal {
+		reports[id] = report
+	}
+	reports[1] = []byte{39}
+	reports[3] = []byte{0x04} // Discharging
+	reports[6] = []byte{0x01} // Boost
+	reports[9] = []byte{0, 0}
+
+	var _, status, err = newFakeHIDSource(reports).Fetch(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Power Failure", status.State)
+	assert.Equal(t, "Battery Power", status.PowerSupplyBy)
+	assert.Equal(t, 0, status.UtilityVoltage)
+	assert.Equal(t, 39, status.BatteryCapacity)
+	assert.Equal(t, "Boost", status.LineInteraction)
+}
+
+func TestHIDSourceMissingReport(t *testing.T) {
+	t.Parallel()
+
+	var reports = map[byte][]byte{}
+	for id, report := range testHIDReportsNormal {
+		reports[id] = report
+	}
+	delete(reports, 5)
+
+	var _, _, err = newFakeHIDSource(reports).Fetch(context.Background())
+	var sErr *scrapeError
+	assert.ErrorAs(t, err, &sErr)
+	assert.Equal(t, stageParseStatus, sErr.stage)
+	assert.Equal(t, "getLoad", sErr.getter)
+}
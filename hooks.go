@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// hookQueueSize is how many events may wait for the hooks before new ones are
+// dropped.
+const hookQueueSize = 64
+
+// The results of a hook run.
+const (
+	hookSuccess = "success"
+	hookFailure = "failure"
+	hookTimeout = "timeout"
+)
+
+// nolint: gochecknoglobals
+var (
+	hookRunsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "hook_runs_total"),
+		"-on-event hook runs by result",
+		[]string{"hook", "result"}, nil,
+	)
+
+	hookDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "hook_last_duration_seconds"),
+		"how long the last run of an -on-event hook took",
+		[]string{"hook"}, nil,
+	)
+)
+
+// hookPayload is what a hook gets on stdin.
+type hookPayload struct {
+	Event    string         `json:"event"`
+	Time     time.Time      `json:"time"`
+	Status   statusDocument `json:"status"`
+	Previous statusDocument `json:"previous"`
+}
+
+// hookRunKey is the hook and result of counted runs.
+type hookRunKey struct {
+	hook   string
+	result string
+}
+
+// hookRunner runs every executable in a directory on each UPS event, one
+// event at a time and in order. Each hook is called with the event name as
+// its argument, the status as CYBERPOWER_* environment variables and as a
+// hookPayload on stdin. It is a prometheus.Collector for the hook results.
+type hookRunner struct {
+	dir     string
+	timeout time.Duration
+	queue   chan upsEvent
+
+	mu        sync.Mutex
+	runs      map[hookRunKey]float64
+	durations map[string]float64
+}
+
+func newHookRunner(dir string, timeout time.Duration) *hookRunner {
+	return &hookRunner{
+		dir:       dir,
+		timeout:   timeout,
+		queue:     make(chan upsEvent, hookQueueSize),
+		runs:      map[hookRunKey]float64{},
+		durations: map[string]float64{},
+	}
+}
+
+// enqueue is an eventDetector handler.
+func (h *hookRunner) enqueue(event upsEvent) {
+	select {
+	case h.queue <- event:
+	default:
+		log.Errorf("ups %s: too many events queued for the hooks, dropping %s", event.ups, event.name)
+	}
+}
+
+// run runs the hooks for queued events until ctx is done.
+func (h *hookRunner) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-h.queue:
+			h.fire(ctx, event)
+		}
+	}
+}
+
+// fire runs every hook for event.
+func (h *hookRunner) fire(ctx context.Context, event upsEvent) {
+	var hooks, err = h.hooks()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	var payload []byte
+	payload, err = json.Marshal(hookPayload{
+		Event:    event.name,
+		Time:     event.time,
+		Status:   newStatusDocument(event.ups, event.device, event.status),
+		Previous: newStatusDocument(event.ups, event.device, event.previous),
+	})
+	if err != nil {
+		log.Errorf("unable to encode hook payload, err: %s", err)
+		return
+	}
+
+	var env = append(os.Environ(),
+		"CYBERPOWER_EVENT="+event.name,
+		"CYBERPOWER_UPS="+event.ups,
+		"CYBERPOWER_MODEL="+event.device.ModelName,
+		"CYBERPOWER_STATE="+event.status.State,
+		"CYBERPOWER_POWER_SUPPLY_BY="+event.status.PowerSupplyBy,
+		"CYBERPOWER_BATTERY_CAPACITY="+strconv.Itoa(event.status.BatteryCapacity),
+		"CYBERPOWER_REMAINING_RUNTIME="+strconv.Itoa(int(event.status.RemainingRuntime.Seconds())),
+		"CYBERPOWER_LOAD_WATTS="+strconv.Itoa(event.status.LoadWatts),
+		"CYBERPOWER_UTILITY_VOLTAGE="+strconv.Itoa(event.status.UtilityVoltage),
+		"CYBERPOWER_TEST_RESULT="+event.status.TestResult,
+	)
+
+	for _, hook := range hooks {
+		var start = time.Now()
+		var result = h.runHook(ctx, hook, event.name, env, payload)
+
+		h.mu.Lock()
+		h.runs[hookRunKey{hook: filepath.Base(hook), result: result}]++
+		h.durations[filepath.Base(hook)] = time.Since(start).Seconds()
+		h.mu.Unlock()
+	}
+}
+
+// hooks lists the executables in the hook directory, hidden files are
+// skipped so editors' swap files are not run.
+func (h *hookRunner) hooks() ([]string, error) {
+	var entries, err = os.ReadDir(h.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read hook dir %s, err: %w", h.dir, err)
+	}
+
+	var hooks []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.Mode()&0o111 == 0 {
+			continue
+		}
+		hooks = append(hooks, filepath.Join(h.dir, entry.Name()))
+	}
+	return hooks, nil
+}
+
+func (h *hookRunner) runHook(ctx context.Context, hook, eventName string, env []string, payload []byte) string {
+	var hookCtx, cancel = context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var cmd = exec.CommandContext(hookCtx, hook, eventName)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(payload)
+	// children of a killed hook may hold its output open, do not wait on them
+	cmd.WaitDelay = time.Second
+	var out, err = cmd.CombinedOutput()
+
+	switch {
+	case errors.Is(hookCtx.Err(), context.DeadlineExceeded):
+		log.Errorf("hook %s timed out after %s on %s", hook, h.timeout, eventName)
+		return hookTimeout
+	case err != nil:
+		log.Errorf("hook %s failed on %s: %s, output: %s", hook, eventName, err, bytes.TrimSpace(out))
+		return hookFailure
+	default:
+		log.Infof("hook %s ran on %s", hook, eventName)
+		return hookSuccess
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (h *hookRunner) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hookRunsDesc
+	ch <- hookDurationDesc
+}
+
+// Collect implements prometheus.Collector.
+func (h *hookRunner) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, count := range h.runs {
+		ch <- prometheus.MustNewConstMetric(hookRunsDesc, prometheus.CounterValue, count, key.hook, key.result)
+	}
+	for hook, seconds := range h.durations {
+		ch <- prometheus.MustNewConstMetric(hookDurationDesc, prometheus.GaugeValue, seconds, hook)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookRunner(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the test hooks are shell scripts")
+	}
+
+	var dir = t.TempDir()
+	var out = filepath.Join(t.TempDir(), "out")
+	var writeHook = func(name, script string, mode os.FileMode) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), mode))
+	}
+	writeHook("10-record", `echo "$1 $CYBERPOWER_UPS $CYBERPOWER_BATTERY_CAPACITY" > `+out+`; cat >> `+out, 0o700)
+	writeHook("20-fail", "exit 3", 0o700)
+	writeHook("30-slow", "sleep 5", 0o700)
+	writeHook("40-not-executable", "exit 0", 0o600)
+	writeHook(".hidden", "exit 0", 0o700)
+
+	var status, err = parsePowerStatus(testOutputBlackout)
+	assert.NoError(t, err)
+	previous, err := parsePowerStatus(testOutputNormal)
+	assert.NoError(t, err)
+
+	var runner = newHookRunner(dir, 500*time.Millisecond)
+	runner.fire(context.Background(), upsEvent{
+		name:     eventOnBattery,
+		ups:      "rack1",
+		time:     status.CollectionTime,
+		device:   Device{ModelName: "CP1500PFCLCDa"},
+		status:   status,
+		previous: previous,
+	})
+
+	recorded, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	var firstLine, stdin, _ = strings.Cut(string(recorded), "\n")
+	assert.Equal(t, "on_battery rack1 39", firstLine)
+
+	var payload hookPayload
+	assert.NoError(t, json.Unmarshal([]byte(stdin), &payload))
+	assert.Equal(t, eventOnBattery, payload.Event)
+	assert.Equal(t, "rack1", payload.Status.UPS)
+	assert.Equal(t, "CP1500PFCLCDa", payload.Status.ModelName)
+	assert.Equal(t, "Battery Power", payload.Status.PowerSupplyBy)
+	assert.Equal(t, float64(1440), payload.Status.RemainingRuntimeSeconds)
+	assert.Equal(t, "Utility Power", payload.Previous.PowerSupplyBy)
+
+	assert.NoError(t, testutil.CollectAndCompare(runner, strings.NewReader(`
+# HELP cyber_power_exporter_hook_runs_total -on-event hook runs by result
+# TYPE cyber_power_exporter_hook_runs_total counter
+cyber_power_exporter_hook_runs_total{hook="10-record",result="success"} 1
+cyber_power_exporter_hook_runs_total{hook="20-fail",result="failure"} 1
+cyber_power_exporter_hook_runs_total{hook="30-slow",result="timeout"} 1
+`), "cyber_power_exporter_hook_runs_total"))
+	assert.Equal(t, 3, testutil.CollectAndCount(runner, "cyber_power_exporter_hook_last_duration_seconds"))
+}
+
+func TestHookRunnerMissingDir(t *testing.T) {
+	t.Parallel()
+
+	var runner = newHookRunner(filepath.Join(t.TempDir(), "nope"), time.Second)
+	runner.fire(context.Background(), upsEvent{name: eventOnBattery, ups: "rack1"})
+	assert.Equal(t, 0, testutil.CollectAndCount(runner))
+}
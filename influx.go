@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var errInfluxStatus = errors.New("influxdb returned an error")
+var errInfluxRejected = errors.New("influxdb rejected the points")
+
+// influxMeasurement is the measurement every point is written to.
+const influxMeasurement = "cyberpower_ups"
+
+// influxBatchSize is the most points sent in one write.
+const influxBatchSize = 5000
+
+// influxMaxPending is how many points are kept while InfluxDB is unreachable,
+// the oldest are dropped beyond it.
+const influxMaxPending = 10000
+
+// The results of a point.
+const (
+	influxWritten  = "written"
+	influxDropped  = "dropped"
+	influxRejected = "rejected"
+)
+
+// nolint: gochecknoglobals
+var (
+	influxPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "influx_points_total"),
+		"points by result, dropped ones did not fit in the buffer while influxdb was unreachable, rejected ones were refused by influxdb",
+		[]string{"result"}, nil,
+	)
+
+	influxPendingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "influx_points_pending"),
+		"points waiting to be written to influxdb",
+		nil, nil,
+	)
+
+	influxTagEscaper   = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	influxFieldEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// influxConfig configures an influxWriter.
+type influxConfig struct {
+	url           string // of the InfluxDB server, e.g. http://localhost:8086
+	version       int    // of the write API, 1 or 2
+	database      string // v1
+	username      string // v1
+	password      string // v1
+	org           string // v2
+	bucket        string // v2
+	token         string // v2, or v1 with token auth
+	flushInterval time.Duration
+}
+
+// writeURL is the write endpoint of the configured API version.
+func (c influxConfig) writeURL() (string, error) {
+	var base, err = url.Parse(c.url)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse influxdb url, err: %w", err)
+	}
+
+	var query = url.Values{"precision": {"ns"}}
+	switch c.version {
+	case 1:
+		base = base.JoinPath("write")
+		query.Set("db", c.database)
+	case 2:
+		base = base.JoinPath("api", "v2", "write")
+		query.Set("org", c.org)
+		query.Set("bucket", c.bucket)
+	default:
+		return "", fmt.Errorf("unsupported influxdb api version %d", c.version)
+	}
+	base.RawQuery = query.Encode()
+	return base.String(), nil
+}
+
+// influxWriter writes every UPS reading to InfluxDB as line protocol. Points
+// are batched and written every flushInterval, points that could not be
+// written are kept and sent with the next batch. It is a prometheus.Collector
+// for the write results.
+type influxWriter struct {
+	config   influxConfig
+	writeURL string
+	client   *http.Client
+
+	flushMu sync.Mutex // one flush at a time so points stay in order
+
+	mu      sync.Mutex
+	pending []string
+	results map[string]float64
+}
+
+func newInfluxWriter(config influxConfig) (*influxWriter, error) {
+	var writeURL, err = config.writeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return &influxWriter{
+		config:   config,
+		writeURL: writeURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		results:  map[string]float64{},
+	}, nil
+}
+
+// observe is a upsMonitor observer.
+func (w *influxWriter) observe(reading upsReading) {
+	if reading.err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, influxLine(reading.ups, reading.device, reading.status))
+	w.trim()
+}
+
+// trim drops the oldest points beyond influxMaxPending. The caller must hold
+// w.mu.
+func (w *influxWriter) trim() {
+	if over := len(w.pending) - influxMaxPending; over > 0 {
+		w.pending = w.pending[over:]
+		w.results[influxDropped] += float64(over)
+	}
+}
+
+// run flushes every flushInterval until ctx is done.
+func (w *influxWriter) run(ctx context.Context) {
+	var ticker = time.NewTicker(w.config.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.flush(ctx)
+		}
+	}
+}
+
+// flush writes the pending points in batches, stopping at the first failed
+// write so the rest are retried in order on the next flush. A batch influxdb
+// rejects would be rejected again, it is dropped instead.
+func (w *influxWriter) flush(ctx context.Context) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	var pending = w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	for len(pending) > 0 {
+		var batch = pending[:min(len(pending), influxBatchSize)]
+		var result = influxWritten
+		if err := w.write(ctx, batch); err != nil {
+			if !errors.Is(err, errInfluxRejected) {
+				log.Errorf("unable to write %d points to influxdb, will retry: %s", len(batch), err)
+				break
+			}
+			log.Errorf("unable to write %d points to influxdb, dropping them: %s", len(batch), err)
+			result = influxRejected
+		}
+		pending = pending[len(batch):]
+
+		w.mu.Lock()
+		w.results[result] += float64(len(batch))
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(pending, w.pending...)
+	w.trim()
+}
+
+func (w *influxWriter) write(ctx context.Context, lines []string) error {
+	var body = strings.Join(lines, "\n") + "\n"
+	var req, err = http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, bytes.NewBufferString(body))
+	if err != nil {
+		return fmt.Errorf("unable to build influxdb request, err: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case w.config.token != "":
+		req.Header.Set("Authorization", "Token "+w.config.token)
+	case w.config.username != "":
+		req.SetBasicAuth(w.config.username, w.config.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to write to influxdb, err: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: %s", errInfluxStatus, resp.Status)
+	case resp.StatusCode >= http.StatusBadRequest:
+		// bad points or credentials, sending them again will not help
+		return fmt.Errorf("%w: %s", errInfluxRejected, resp.Status)
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return fmt.Errorf("%w: %s", errInfluxStatus, resp.Status)
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (w *influxWriter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- influxPointsDesc
+	ch <- influxPendingDesc
+}
+
+// Collect implements prometheus.Collector.
+func (w *influxWriter) Collect(ch chan<- prometheus.Metric) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for result, count := range w.results {
+		ch <- prometheus.MustNewConstMetric(influxPointsDesc, prometheus.CounterValue, count, result)
+	}
+	ch <- prometheus.MustNewConstMetric(influxPendingDesc, prometheus.GaugeValue, float64(len(w.pending)))
+}
+
+// influxHandler serves the latest reading of every UPS as line protocol, for
+// Telegraf's inputs.http with data_format = "influx".
+func influxHandler(monitors []*upsMonitor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		var body strings.Builder
+		for _, monitor := range monitors {
+			var device, status, err = monitor.Latest()
+			if err != nil {
+				continue
+			}
+			body.WriteString(influxLine(monitor.name, device, status))
+			body.WriteString("\n")
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(body.String()))
+	})
+}
+
+// influxLine is a reading as a line protocol point timestamped with its
+// CollectionTime. While communication with the UPS is lost only its state is
+// written, the rest of the reading is not known.
+func influxLine(ups string, device Device, status DeviceStatus) string {
+	var line strings.Builder
+	line.WriteString(influxMeasurement)
+	line.WriteString(",ups=" + influxTagEscaper.Replace(ups))
+	if device.ModelName != "" {
+		line.WriteString(",model_name=" + influxTagEscaper.Replace(device.ModelName))
+	}
+
+	var fields = []string{
+		"state=" + influxString(status.State),
+		"communication_lost=" + strconv.FormatBool(status.State == "Lost Communication"),
+	}
+	if status.State != "Lost Communication" {
+		fields = append(fields,
+			"power_supply_by="+influxString(status.PowerSupplyBy),
+			"on_battery="+strconv.FormatBool(status.PowerSupplyBy == "Battery Power"),
+			"utility_voltage="+influxInt(status.UtilityVoltage),
+			"output_voltage="+influxInt(status.OutputVoltage),
+			"battery_capacity="+influxInt(status.BatteryCapacity),
+			"remaining_runtime_seconds="+strconv.FormatFloat(status.RemainingRuntime.Seconds(), 'f', -1, 64),
+			"load_watts="+influxInt(status.LoadWatts),
+			"load_pct="+influxInt(status.LoadPct),
+			"line_interaction="+influxString(status.LineInteraction),
+			"test_result="+influxString(status.TestResult),
+			"last_power_event="+influxString(status.LastPowerEvent),
+			"rating_voltage="+influxInt(device.RatingVoltage),
+			"rating_power_watts="+influxInt(device.RatingPowerWatts),
+			"rating_power_va="+influxInt(device.RatingPowerVA),
+		)
+	}
+	line.WriteString(" " + strings.Join(fields, ","))
+
+	var timestamp = status.CollectionTime
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	line.WriteString(" " + strconv.FormatInt(timestamp.UnixNano(), 10))
+	return line.String()
+}
+
+func influxString(value string) string {
+	return `"` + influxFieldEscaper.Replace(value) + `"`
+}
+
+func influxInt(value int) string {
+	return strconv.Itoa(value) + "i"
+}
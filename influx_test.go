@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfluxLine(t *testing.T) {
+	t.Parallel()
+
+	var status, err = parsePowerStatus(testOutputBlackout)
+	assert.NoError(t, err)
+	device, err := parseDeviceProperties(testOutputBlackout)
+	assert.NoError(t, err)
+	status.CollectionTime = time.Unix(1678369101, 5)
+
+	assert.Equal(t, `cyberpower_ups,ups=rack\ 1,model_name=CP1500PFCLCDa `+
+		`state="Power Failure",communication_lost=false,power_supply_by="Battery Power",on_battery=true,`+
+		`utility_voltage=0i,output_voltage=120i,battery_capacity=39i,remaining_runtime_seconds=1440,load_watts=120i,load_pct=12i,`+
+		`line_interaction="None",test_result="Passed",last_power_event="Blackout",`+
+		`rating_voltage=120i,rating_power_watts=1000i,rating_power_va=1500i 1678369101000000005`,
+		influxLine("rack 1", device, status))
+
+	// tags and strings are escaped
+	var line = influxLine("a,b=c", Device{ModelName: "x y"}, DeviceStatus{TestResult: `"Failed"\`})
+	assert.True(t, strings.HasPrefix(line, `cyberpower_ups,ups=a\,b\=c,model_name=x\ y `), line)
+	assert.Contains(t, line, `,test_result="\"Failed\"\\",`)
+
+	assert.Equal(t, `cyberpower_ups,ups=rack1 state="Lost Communication",communication_lost=true 1678369101000000005`,
+		influxLine("rack1", Device{}, DeviceStatus{State: "Lost Communication", CollectionTime: status.CollectionTime}))
+}
+
+func TestInfluxWriteURL(t *testing.T) {
+	t.Parallel()
+
+	var writeURL, err = influxConfig{url: "http://influx:8086", version: 1, database: "ups"}.writeURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://influx:8086/write?db=ups&precision=ns", writeURL)
+
+	writeURL, err = influxConfig{url: "http://influx:8086/", version: 2, org: "home", bucket: "ups"}.writeURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://influx:8086/api/v2/write?bucket=ups&org=home&precision=ns", writeURL)
+
+	_, err = influxConfig{url: "http://influx:8086", version: 3}.writeURL()
+	assert.Error(t, err)
+}
+
+func TestInfluxWriter(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var down = true
+	var bodies []string
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		var body, err = io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	var writer, err = newInfluxWriter(influxConfig{url: server.URL, version: 2, org: "home", bucket: "ups", token: "secret"})
+	assert.NoError(t, err)
+
+	var reading = func(capacity int) upsReading {
+		return upsReading{ups: "rack1", status: DeviceStatus{
+			State:           "Lost Communication",
+			BatteryCapacity: capacity,
+			CollectionTime:  time.Unix(int64(capacity), 0),
+		}}
+	}
+
+	// points are kept while influxdb is down
+	writer.observe(reading(1))
+	writer.observe(upsReading{ups: "rack1", err: io.EOF})
+	writer.flush(context.Background())
+	writer.observe(reading(2))
+
+	assert.NoError(t, testutil.CollectAndCompare(writer, strings.NewReader(`
+# HELP cyber_power_exporter_influx_points_pending points waiting to be written to influxdb
+# TYPE cyber_power_exporter_influx_points_pending gauge
+cyber_power_exporter_influx_points_pending 2
+`)))
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	writer.flush(context.Background())
+
+	assert.Equal(t, []string{
+		`cyberpower_ups,ups=rack1 state="Lost Communication",communication_lost=true 1000000000` + "\n" +
+			`cyberpower_ups,ups=rack1 state="Lost Communication",communication_lost=true 2000000000` + "\n",
+	}, bodies)
+
+	assert.NoError(t, testutil.CollectAndCompare(writer, strings.NewReader(`
+# HELP cyber_power_exporter_influx_points_pending points waiting to be written to influxdb
+# TYPE cyber_power_exporter_influx_points_pending gauge
+cyber_power_exporter_influx_points_pending 0
+# HELP cyber_power_exporter_influx_points_total points by result, dropped ones did not fit in the buffer while influxdb was unreachable, rejected ones were refused by influxdb
+# TYPE cyber_power_exporter_influx_points_total counter
+cyber_power_exporter_influx_points_total{result="written"} 2
+`)))
+}
+
+func TestInfluxWriterRejected(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var statuses = []int{http.StatusTooManyRequests, http.StatusBadRequest}
+	var requests int
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	var writer, err = newInfluxWriter(influxConfig{url: server.URL, version: 2, org: "home", bucket: "ups", token: "secret"})
+	assert.NoError(t, err)
+	writer.observe(upsReading{ups: "rack1", status: DeviceStatus{State: "Lost Communication", CollectionTime: time.Unix(1, 0)}})
+
+	// 429 is retried on the next flush, 400 is not
+	writer.flush(context.Background())
+	writer.flush(context.Background())
+	writer.flush(context.Background())
+	mu.Lock()
+	assert.Equal(t, 2, requests)
+	mu.Unlock()
+
+	assert.NoError(t, testutil.CollectAndCompare(writer, strings.NewReader(`
+# HELP cyber_power_exporter_influx_points_pending points waiting to be written to influxdb
+# TYPE cyber_power_exporter_influx_points_pending gauge
+cyber_power_exporter_influx_points_pending 0
+# HELP cyber_power_exporter_influx_points_total points by result, dropped ones did not fit in the buffer while influxdb was unreachable, rejected ones were refused by influxdb
+# TYPE cyber_power_exporter_influx_points_total counter
+cyber_power_exporter_influx_points_total{result="rejected"} 1
+`)))
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 
@@ -28,13 +33,65 @@ func main() {
 	var sigChannel = make(chan os.Signal, 1)
 	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 
-	// get user opts
-	var cmdPath, promAddr string
-	var pollInterval time.Duration
+	// get user opts, a -config file is decoded on top of them
+	var conf configFile
+	var configPath, webhookEvents string
 	var v bool
-	flag.StringVar(&cmdPath, "cmd-path", "/usr/sbin/pwrstat", "absolute path to pwstat command")
-	flag.StringVar(&promAddr, "prom-addr", ":9300", "bind address of the prom http server")
-	flag.DurationVar(&pollInterval, "poll-interval", time.Second*5, "time interval to gather power stats")
+	flag.StringVar(&configPath, "config", "", "YAML config file, its keys override the flags, reloaded on SIGHUP and POST /-/reload. See cyberpower_exporter.example.yml")
+	flag.Var(&conf.upsFlags, "ups", "a UPS to monitor as name=source[,option=value...], repeatable, options are cmd-path, exec-timeout, device, addr, ups, replay, replay-speed and interval. e.g. -ups rack1=pwrstat -ups rack2=nut,addr=10.0.0.2:3493")
+	flag.StringVar(&conf.upsName, "ups-name", "cyberpower", "ups label of the UPS when -ups is not used")
+	flag.StringVar(&conf.sourceKind, "source", "pwrstat", "where to read UPS stats from when -ups is not used: pwrstat, hid, nut or replay")
+	flag.StringVar(&conf.sourceDefaults.cmdPath, "cmd-path", "/usr/sbin/pwrstat", "absolute path to pwstat command")
+	flag.DurationVar(&conf.sourceDefaults.execTimeout, "exec-timeout", defaultExecTimeout, "how long pwrstat may run before it and its children are killed")
+	flag.StringVar(&conf.sourceDefaults.hidDevice, "hid-device", "", "hidraw device of the UPS when -source=hid, e.g. /dev/hidraw0")
+	flag.StringVar(&conf.sourceDefaults.nutAddr, "nut-addr", "localhost:3493", "upsd address when -source=nut")
+	flag.StringVar(&conf.sourceDefaults.nutUPS, "nut-ups", "", "upsd UPS name when -source=nut, defaults to the first one upsd lists")
+	flag.StringVar(&conf.sourceDefaults.replayPath, "replay", "", "directory or tarball of pwrstat output recorded with -record-dir to play back when -source=replay")
+	flag.Float64Var(&conf.sourceDefaults.replaySpeed, "replay-speed", 1, "play -replay captures this many times faster than they were recorded, 0 plays one per read")
+	flag.StringVar(&conf.Record.Dir, "record-dir", "", "if set, save the raw output of every pwrstat run to <dir>/<ups>/ for bug reports and -replay, identical consecutive outputs are saved once")
+	flag.IntVar(&conf.Record.Keep, "record-keep", defaultRecordKeep, "how many -record-dir captures to keep per UPS, the oldest are removed")
+	flag.StringVar(&conf.Listen.NUT.Addr, "nut-server-addr", "", "if set, serve every UPS over the NUT upsd protocol on this address, e.g. :3493")
+	flag.IntVar(&conf.Listen.NUT.LowBattery, "nut-server-low-battery", 10, "battery capacity % at or below which NUT clients see low battery (LB)")
+	flag.StringVar(&conf.Listen.NUT.Username, "nut-server-username", "", "username NUT clients must LOGIN with, required for FSD")
+	flag.StringVar(&conf.Listen.NUT.Password, "nut-server-password", "", "password NUT clients must LOGIN with, required for FSD")
+	flag.StringVar(&conf.Listen.NIS.Addr, "nis-addr", "", "if set, serve a UPS like the apcupsd network information server on this address, e.g. :3551")
+	flag.StringVar(&conf.Listen.NIS.UPS, "nis-ups", "", "ups name to serve with -nis-addr, defaults to the first UPS")
+	flag.StringVar(&conf.StateFile, "state-file", "", "if set, persist energy, power event and on battery totals to this file so they survive restarts")
+	flag.Float64Var(&conf.EnergyPricePerKWh, "energy-price-per-kwh", 0, "if set, export the cost of the energy each UPS delivered at this price")
+	flag.IntVar(&conf.Alerts.Shutdown.BatteryCapacity, "shutdown-battery-capacity", 0, "if set, shut down when a UPS on battery is at or below this battery capacity %")
+	flag.DurationVar(&conf.Alerts.Shutdown.RemainingRuntime, "shutdown-runtime", 0, "if set, shut down when a UPS on battery is at or below this remaining runtime")
+	flag.DurationVar(&conf.Alerts.Shutdown.OnBattery, "shutdown-on-battery", 0, "if set, shut down when a UPS has been on battery this long")
+	flag.DurationVar(&conf.Alerts.Shutdown.Grace, "shutdown-grace", time.Minute, "how long to wait before shutting down, cancelled if utility power returns")
+	flag.Var((*stringsFlag)(&conf.Alerts.Shutdown.Exec), "shutdown-exec", "command to run with sh -c to shut down, repeatable")
+	flag.Var((*stringsFlag)(&conf.Alerts.Shutdown.URLs), "shutdown-url", "url to POST to on shutdown, e.g. a hook on another host, repeatable")
+	flag.BoolVar(&conf.Alerts.Shutdown.DryRun, "shutdown-dry-run", false, "log the shutdown actions instead of running them")
+	flag.StringVar(&conf.Outputs.Hooks.Dir, "on-event", "", "if set, run every executable in this directory on UPS events, e.g. on_battery, with the status in CYBERPOWER_* env vars and as JSON on stdin")
+	flag.DurationVar(&conf.Outputs.Hooks.Timeout, "on-event-timeout", 10*time.Second, "how long an -on-event hook may run before it is killed")
+	flag.IntVar(&conf.Alerts.LowBattery, "event-low-battery", 20, "battery capacity % at or below which the low_battery event fires")
+	flag.Var((*stringsFlag)(&conf.Outputs.Webhooks.URLs), "webhook-url", "url to POST a notification to on UPS events, e.g. a Slack, Discord, ntfy or Gotify webhook, repeatable")
+	flag.StringVar(&conf.Outputs.Webhooks.TemplateFile, "webhook-template", "", "file with a Go text/template of the webhook body, defaults to a Slack compatible {\"text\": ...}")
+	flag.StringVar(&conf.Outputs.Webhooks.ContentType, "webhook-content-type", "application/json", "content type of the webhook body")
+	flag.StringVar(&webhookEvents, "webhook-events", defaultWebhookEvents, "comma separated UPS events to send webhooks for")
+	flag.DurationVar(&conf.Outputs.Webhooks.Dedup, "webhook-dedup", 5*time.Minute, "do not repeat a webhook for the same UPS and event within this window")
+	flag.IntVar(&conf.Outputs.Webhooks.Retries, "webhook-retries", 3, "how many times to retry a failed webhook, with exponential backoff")
+	flag.StringVar(&conf.Outputs.MQTT.Broker, "mqtt-broker", "", "if set, publish readings to this MQTT broker, e.g. tcp://localhost:1883")
+	flag.StringVar(&conf.Outputs.MQTT.ClientID, "mqtt-client-id", "cyberpower_exporter", "MQTT client id")
+	flag.StringVar(&conf.Outputs.MQTT.Username, "mqtt-username", "", "MQTT username")
+	flag.StringVar(&conf.Outputs.MQTT.Password, "mqtt-password", "", "MQTT password")
+	flag.StringVar(&conf.Outputs.MQTT.TopicPrefix, "mqtt-topic-prefix", "cyberpower", "readings are published to <prefix>/<ups>/<field>")
+	flag.StringVar(&conf.Outputs.MQTT.DiscoveryPrefix, "mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix, empty disables discovery")
+	flag.StringVar(&conf.Outputs.Influx.URL, "influx-url", "", "if set, write readings to this InfluxDB server, e.g. http://localhost:8086")
+	flag.IntVar(&conf.Outputs.Influx.Version, "influx-version", 2, "InfluxDB write API version, 1 or 2")
+	flag.StringVar(&conf.Outputs.Influx.Database, "influx-database", "cyberpower", "InfluxDB v1 database")
+	flag.StringVar(&conf.Outputs.Influx.Username, "influx-username", "", "InfluxDB v1 username")
+	flag.StringVar(&conf.Outputs.Influx.Password, "influx-password", "", "InfluxDB v1 password")
+	flag.StringVar(&conf.Outputs.Influx.Org, "influx-org", "", "InfluxDB v2 organization")
+	flag.StringVar(&conf.Outputs.Influx.Bucket, "influx-bucket", "cyberpower", "InfluxDB v2 bucket")
+	flag.StringVar(&conf.Outputs.Influx.Token, "influx-token", "", "InfluxDB API token")
+	flag.DurationVar(&conf.Outputs.Influx.FlushInterval, "influx-flush-interval", 10*time.Second, "how often to write batched readings to InfluxDB")
+	flag.StringVar(&conf.Listen.Metrics, "prom-addr", ":9300", "bind address of the prom http server")
+	flag.StringVar(&conf.Listen.WebConfigFile, "web.config.file", "", "Prometheus web config file with TLS and basic auth settings for the http server, like node_exporter's")
+	flag.DurationVar(&conf.PollInterval, "poll-interval", time.Second*5, "minimum time between UPS reads, scrapes within this interval are served from cache")
 	flag.BoolVar(&v, "version", false, "print version")
 	flag.BoolVar(&v, "v", false, "print version")
 
@@ -49,83 +106,211 @@ func main() {
 		os.Exit(0)
 	}
 
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-
-		var server = &http.Server{
-			Addr:         promAddr,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
+	conf.Outputs.Webhooks.Events = strings.Split(webhookEvents, ",")
+	var flagConf = conf
+	if configPath != "" {
+		var err error
+		conf, err = loadConfigFile(configPath, flagConf)
+		if err != nil {
+			log.Fatal(err)
 		}
+	} else if err := conf.validate(); err != nil {
+		log.Fatal(err)
+	}
+	// validated above
+	var configs, _ = conf.upsConfigs()
+	webhooks, _ := conf.webhookConfig()
 
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatal("http server error: ", err)
+	var state = persistedState{UPS: map[string]upsCounters{}}
+	if conf.StateFile != "" {
+		var err error
+		state, err = loadState(conf.StateFile)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
-	log.Info("started, go to grafana to monitor")
+	}
 
-	gatherAndSaveStats(cmdPath)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
 
-	var ticker = time.NewTicker(pollInterval)
-	for {
-		select {
-		case <-ticker.C:
-			gatherAndSaveStats(cmdPath)
+	var registry = prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
 
-		case <-sigChannel:
-			log.Info("shutting down")
-			return
-		}
+	var events = newEventDetector(conf.Alerts.LowBattery)
+	var stream = newStreamBroadcaster()
+	events.handle(stream.transition)
+	if conf.Outputs.Hooks.Dir != "" {
+		var hooks = newHookRunner(conf.Outputs.Hooks.Dir, conf.Outputs.Hooks.Timeout)
+		events.handle(hooks.enqueue)
+		registry.MustRegister(hooks)
+		go hooks.run(ctx)
 	}
-}
 
-func gatherAndSaveStats(cmdPath string) {
-	out, err := getPowerStats(cmdPath)
+	// the notifier sends nothing without urls, it is kept so a reload can add some
+	var notifier, err = newWebhookNotifier(webhooks)
 	if err != nil {
-		log.Error(err)
+		log.Fatal(err)
 	}
+	events.handle(notifier.enqueue)
+	registry.MustRegister(notifier)
+	go notifier.run(ctx)
 
-	status, err := parsePowerStatus(out)
-	if err != nil {
-		log.Error(err)
+	var mqttPub *mqttPublisher
+	if conf.Outputs.MQTT.Broker != "" {
+		mqttPub = newMQTTPublisher(conf.mqttConfig())
+		mqttPub.connect()
+		go mqttPub.run(ctx)
 	}
 
-	device, err := parseDeviceProperties(out)
-	if err != nil {
-		log.Error(err)
+	var influxOut *influxWriter
+	if conf.Outputs.Influx.URL != "" {
+		influxOut, err = newInfluxWriter(conf.influxConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+		registry.MustRegister(influxOut)
+		go influxOut.run(ctx)
+	}
+
+	var monitors = make([]*upsMonitor, 0, len(configs))
+	var providers = make(map[string]statusProvider, len(configs))
+	var engines = make(map[string]*shutdownEngine, len(configs))
+	for _, config := range configs {
+		var source, err = newSource(config.kind, config.source)
+		if err != nil {
+			log.Fatalf("ups %s: %s", config.name, err)
+		}
+		var monitor = newUPSMonitor(config.name, source, config.minInterval)
+		monitor.meter.pricePerKWh = conf.EnergyPricePerKWh
+		monitor.restoreCounters(state.UPS[config.name])
+		// the engine does nothing while the policy is disabled, it is kept so a reload can enable it
+		engines[config.name] = newShutdownEngine(config.name, conf.shutdownPolicy())
+		monitor.observe(engines[config.name].observe)
+		monitor.observe(stream.observe)
+		monitor.observe(events.observe)
+		if mqttPub != nil {
+			monitor.observe(mqttPub.observe)
+		}
+		if influxOut != nil {
+			monitor.observe(influxOut.observe)
+		}
+		monitors = append(monitors, monitor)
+		providers[config.name] = monitor
+	}
+
+	if configPath != "" {
+		var reloader = newReloader(configPath, flagConf, conf, monitors, engines, events, notifier)
+		registry.MustRegister(reloader)
+		http.Handle("POST /-/reload", reloader)
+		http.Handle("PUT /-/reload", reloader)
+
+		var hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				_ = reloader.reload()
+			}
+		}()
 	}
 
-	switch status.State {
-	case "Normal":
-		stateGauge.WithLabelValues(device.ModelName).Set(0)
-	case "Power Failure":
-		stateGauge.WithLabelValues(device.ModelName).Set(1)
+	registry.MustRegister(NewUPSCollector(monitors...))
+	for _, monitor := range monitors {
+		go monitor.poll(ctx)
 	}
+	if conf.StateFile != "" {
+		go saveStatePeriodically(ctx, conf.StateFile, monitors)
+	}
+
+	go func() {
+		http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		http.Handle("/influx", influxHandler(monitors))
+		newStatusAPI(monitors).register(http.DefaultServeMux)
+		http.Handle("GET /api/v1/stream", stream)
+
+		var server = &http.Server{
+			Handler:      http.DefaultServeMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
 
-	switch status.PowerSupplyBy {
-	case "Utility Power":
-		powerSuppliedByGauge.WithLabelValues(device.ModelName).Set(0)
-	case "Battery Power":
-		powerSuppliedByGauge.WithLabelValues(device.ModelName).Set(1)
+		listener, err := net.Listen("tcp", conf.Listen.Metrics)
+		if err != nil {
+			log.Fatal("http server error: ", err)
+		}
+		if err := serveHTTP(listener, server, conf.Listen.WebConfigFile); err != nil {
+			log.Fatal("http server error: ", err)
+		}
+	}()
+
+	if conf.Listen.NUT.Addr != "" {
+		listener, err := net.Listen("tcp", conf.Listen.NUT.Addr)
+		if err != nil {
+			log.Fatal("nut server error: ", err)
+		}
+		var nutSrv = newNUTServer(providers, conf.Listen.NUT.LowBattery, conf.Listen.NUT.Username, conf.Listen.NUT.Password)
+		go func() {
+			if err := nutSrv.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	if status.LineInteraction == "None" {
-		lineInteractionGauge.WithLabelValues(device.ModelName).Set(0)
-	} else {
-		lineInteractionGauge.WithLabelValues(device.ModelName).Set(1)
+	if nisAddr, nisUPS := conf.Listen.NIS.Addr, conf.Listen.NIS.UPS; nisAddr != "" {
+		if nisUPS == "" {
+			nisUPS = configs[0].name
+		}
+		var provider, ok = providers[nisUPS]
+		if !ok {
+			log.Fatalf("-nis-ups %s is not a configured ups", nisUPS)
+		}
+		listener, err := net.Listen("tcp", nisAddr)
+		if err != nil {
+			log.Fatal("nis server error: ", err)
+		}
+		var nisSrv = newNISServer(provider)
+		go func() {
+			if err := nisSrv.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
+	log.Info("started, go to grafana to monitor")
 
-	if status.TestResult == "Passed" {
-		testResultGauge.WithLabelValues(device.ModelName).Set(0)
-	} else {
-		testResultGauge.WithLabelValues(device.ModelName).Set(1)
+	<-sigChannel
+	log.Info("shutting down")
+	cancel()
+	if mqttPub != nil {
+		mqttPub.close()
 	}
+	if influxOut != nil {
+		var flushCtx, flushCancel = context.WithTimeout(context.Background(), 5*time.Second)
+		influxOut.flush(flushCtx)
+		flushCancel()
+	}
+	if conf.StateFile != "" {
+		if err := saveMonitors(conf.StateFile, monitors); err != nil {
+			log.Error(err)
+		}
+	}
+}
 
-	utilityVoltageGauge.WithLabelValues(device.ModelName).Set(float64(status.UtilityVoltage))
-	outputVoltageGauge.WithLabelValues(device.ModelName).Set(float64(status.OutputVoltage))
-	batteryCapacityGauge.WithLabelValues(device.ModelName).Set(float64(status.BatteryCapacity))
-	remainingRuntimeGauge.WithLabelValues(device.ModelName).Set(float64(status.RemainingRuntime.Seconds()))
-	loadWattsGauge.WithLabelValues(device.ModelName).Set(float64(status.LoadWatts))
-	loadPctGauge.WithLabelValues(device.ModelName).Set(float64(status.LoadPct))
-	lastPowerEventDurationGauge.WithLabelValues(device.ModelName).Set(float64(status.LastPowerEventDuration.Seconds()))
+// saveStatePeriodically persists the monitors' totals every minute so a crash
+// loses at most a minute of accounting.
+func saveStatePeriodically(ctx context.Context, path string, monitors []*upsMonitor) {
+	var ticker = time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveMonitors(path, monitors); err != nil {
+				log.Error(err)
+			}
+		}
+	}
 }
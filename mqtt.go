@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// mqttPublishTimeout bounds how long we wait for the broker to take a message.
+const mqttPublishTimeout = 5 * time.Second
+
+// mqttQueueSize is how many readings may wait to be published before new
+// ones are dropped.
+const mqttQueueSize = 64
+
+// mqttUnsafeChars are replaced in ups names used in topics and ids.
+// nolint: gochecknoglobals
+var mqttUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mqttConfig configures an mqttPublisher.
+type mqttConfig struct {
+	broker          string // e.g. tcp://localhost:1883
+	clientID        string
+	username        string
+	password        string
+	topicPrefix     string // readings go to <topicPrefix>/<ups>/<field>
+	discoveryPrefix string // Home Assistant discovery prefix, empty disables discovery
+}
+
+// haSensor is a Home Assistant sensor we announce through discovery.
+type haSensor struct {
+	component   string // sensor or binary_sensor
+	field       string
+	name        string
+	deviceClass string
+	unit        string
+}
+
+// haSensors are the fields announced to Home Assistant, every field is
+// published whether it is announced or not.
+// nolint: gochecknoglobals
+var haSensors = []haSensor{
+	{component: "sensor", field: "state", name: "State"},
+	{component: "sensor", field: "power_supply_by", name: "Power supplied by"},
+	{component: "sensor", field: "utility_voltage", name: "Utility voltage", deviceClass: "voltage", unit: "V"},
+	{component: "sensor", field: "output_voltage", name: "Output voltage", deviceClass: "voltage", unit: "V"},
+	{component: "sensor", field: "battery_capacity", name: "Battery", deviceClass: "battery", unit: "%"},
+	{component: "sensor", field: "remaining_runtime_seconds", name: "Remaining runtime", deviceClass: "duration", unit: "s"},
+	{component: "sensor", field: "load_watts", name: "Load", deviceClass: "power", unit: "W"},
+	{component: "sensor", field: "load_pct", name: "Load percent", unit: "%"},
+	{component: "sensor", field: "test_result", name: "Self test result"},
+	{component: "sensor", field: "last_power_event", name: "Last power event"},
+	{component: "binary_sensor", field: "on_battery", name: "On battery"},
+}
+
+// mqttPublisher publishes every UPS reading to an MQTT broker, one retained
+// topic per field, and announces the UPSs to Home Assistant. The broker marks
+// us offline through our last will if we go away.
+type mqttPublisher struct {
+	config mqttConfig
+	client mqtt.Client
+	queue  chan upsReading
+
+	mu         sync.Mutex
+	discovered map[string]bool // ups
+}
+
+func newMQTTPublisher(config mqttConfig) *mqttPublisher {
+	var p = &mqttPublisher{
+		config:     config,
+		queue:      make(chan upsReading, mqttQueueSize),
+		discovered: map[string]bool{},
+	}
+
+	var opts = mqtt.NewClientOptions().
+		AddBroker(config.broker).
+		SetClientID(config.clientID).
+		SetUsername(config.username).
+		SetPassword(config.password).
+		SetWill(p.availabilityTopic(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Errorf("mqtt connection lost: %s", err)
+		})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+// availabilityTopic is where we say whether the exporter is online.
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.config.topicPrefix + "/status"
+}
+
+// upsTopic is the topic of a field of a UPS.
+func (p *mqttPublisher) upsTopic(ups, field string) string {
+	return p.config.topicPrefix + "/" + mqttUnsafeChars.ReplaceAllString(ups, "_") + "/" + field
+}
+
+// onConnect marks us online and has discovery resent, the broker may have
+// lost its retained messages.
+func (p *mqttPublisher) onConnect(client mqtt.Client) {
+	log.Infof("connected to mqtt broker %s", p.config.broker)
+
+	p.mu.Lock()
+	p.discovered = map[string]bool{}
+	p.mu.Unlock()
+
+	client.Publish(p.availabilityTopic(), 1, true, "online")
+}
+
+// connect starts connecting to the broker, it keeps retrying in the
+// background if the broker is not up yet.
+func (p *mqttPublisher) connect() {
+	p.client.Connect()
+}
+
+// observe is a upsMonitor observer.
+func (p *mqttPublisher) observe(reading upsReading) {
+	select {
+	case p.queue <- reading:
+	default:
+		log.Errorf("ups %s: too many readings queued for mqtt, dropping one", reading.ups)
+	}
+}
+
+// close marks us offline and disconnects, the broker does not send our last
+// will on a clean disconnect.
+func (p *mqttPublisher) close() {
+	if p.client.IsConnectionOpen() {
+		p.publish(p.availabilityTopic(), true, "offline")
+	}
+	p.client.Disconnect(uint(time.Second / time.Millisecond))
+}
+
+// run publishes queued readings until ctx is done.
+func (p *mqttPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reading := <-p.queue:
+			p.publishReading(reading)
+		}
+	}
+}
+
+// publishReading publishes the fields of a reading, or marks the UPS
+// unavailable if there is no usable reading.
+func (p *mqttPublisher) publishReading(reading upsReading) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+
+	var availability = p.upsTopic(reading.ups, "availability")
+	if reading.err != nil || reading.status.State == "Lost Communication" {
+		p.publish(availability, true, "offline")
+		return
+	}
+
+	p.mu.Lock()
+	var discover = p.config.discoveryPrefix != "" && !p.discovered[reading.ups]
+	p.discovered[reading.ups] = true
+	p.mu.Unlock()
+	if discover {
+		p.publishDiscovery(reading.ups, reading.device)
+	}
+
+	var fields, err = mqttFields(newStatusDocument(reading.ups, reading.device, reading.status))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, field := range sortedKeys(fields) {
+		p.publish(p.upsTopic(reading.ups, field), true, fields[field])
+	}
+	p.publish(availability, true, "online")
+}
+
+// publishDiscovery announces a UPS and its sensors to Home Assistant.
+func (p *mqttPublisher) publishDiscovery(ups string, device Device) {
+	var objectID = "cyberpower_" + mqttUnsafeChars.ReplaceAllString(ups, "_")
+
+	for _, sensor := range haSensors {
+		var config = map[string]any{
+			"name":        sensor.name,
+			"unique_id":   objectID + "_" + sensor.field,
+			"object_id":   objectID + "_" + sensor.field,
+			"state_topic": p.upsTopic(ups, sensor.field),
+			"availability": []map[string]string{
+				{"topic": p.availabilityTopic()},
+				{"topic": p.upsTopic(ups, "availability")},
+			},
+			"availability_mode": "all",
+			"device": map[string]any{
+				"identifiers":  []string{objectID},
+				"name":         ups,
+				"manufacturer": "CyberPower",
+				"model":        device.ModelName,
+				"sw_version":   device.FirmwareNumber,
+			},
+		}
+		if sensor.deviceClass != "" {
+			config["device_class"] = sensor.deviceClass
+		}
+		if sensor.unit != "" {
+			config["unit_of_measurement"] = sensor.unit
+			config["state_class"] = "measurement"
+		}
+		if sensor.component == "binary_sensor" {
+			config["payload_on"], config["payload_off"] = "ON", "OFF"
+		}
+
+		var payload, err = json.Marshal(config)
+		if err != nil {
+			log.Errorf("unable to encode home assistant discovery config, err: %s", err)
+			return
+		}
+		p.publish(fmt.Sprintf("%s/%s/%s/%s/config", p.config.discoveryPrefix, sensor.component, objectID, sensor.field), true, string(payload))
+	}
+}
+
+func (p *mqttPublisher) publish(topic string, retained bool, payload string) {
+	var token = p.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		log.Errorf("mqtt publish to %s timed out", topic)
+	} else if err := token.Error(); err != nil {
+		log.Errorf("mqtt publish to %s failed: %s", topic, err)
+	}
+}
+
+// mqttFields flattens a statusDocument into a payload per field. Numbers are
+// published as is, and on_battery is added as ON or OFF.
+func mqttFields(doc statusDocument) (map[string]string, error) {
+	var encoded, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode ups status, err: %w", err)
+	}
+	var values map[string]any
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return nil, fmt.Errorf("unable to decode ups status, err: %w", err)
+	}
+	delete(values, "ups")
+
+	var fields = make(map[string]string, len(values)+1)
+	for field, value := range values {
+		switch value := value.(type) {
+		case float64:
+			fields[field] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			fields[field] = fmt.Sprint(value)
+		}
+	}
+
+	fields["on_battery"] = "OFF"
+	if doc.PowerSupplyBy == "Battery Power" {
+		fields["on_battery"] = "ON"
+	}
+	return fields, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// startMQTTBroker runs an embedded broker and returns its address and the
+// latest payload published to each topic.
+func startMQTTBroker(t *testing.T) (string, func() map[string]string) {
+	t.Helper()
+
+	var broker = mochi.New(&mochi.Options{InlineClient: true})
+	assert.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+
+	var listener = listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	assert.NoError(t, broker.AddListener(listener))
+	assert.NoError(t, broker.Serve())
+	t.Cleanup(func() { _ = broker.Close() })
+
+	var mu sync.Mutex
+	var messages = map[string]string{}
+	assert.NoError(t, broker.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages[pk.TopicName] = string(pk.Payload)
+	}))
+
+	return "tcp://" + listener.Address(), func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		var copied = make(map[string]string, len(messages))
+		for topic, payload := range messages {
+			copied[topic] = payload
+		}
+		return copied
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	t.Parallel()
+
+	var addr, messages = startMQTTBroker(t)
+	var publisher = newMQTTPublisher(mqttConfig{
+		broker:          addr,
+		clientID:        "test",
+		topicPrefix:     "cyberpower",
+		discoveryPrefix: "homeassistant",
+	})
+	publisher.connect()
+	assert.Eventually(t, publisher.client.IsConnectionOpen, 5*time.Second, 10*time.Millisecond)
+
+	var status, err = parsePowerStatus(testOutputBlackout)
+	assert.NoError(t, err)
+	device, err := parseDeviceProperties(testOutputBlackout)
+	assert.NoError(t, err)
+	publisher.publishReading(upsReading{ups: "rack 1", device: device, status: status})
+
+	assert.Eventually(t, func() bool { return messages()["cyberpower/rack_1/availability"] == "online" }, 5*time.Second, 10*time.Millisecond)
+	var got = messages()
+	assert.Equal(t, "online", got["cyberpower/status"])
+	assert.Equal(t, "Power Failure", got["cyberpower/rack_1/state"])
+	assert.Equal(t, "39", got["cyberpower/rack_1/battery_capacity"])
+	assert.Equal(t, "1440", got["cyberpower/rack_1/remaining_runtime_seconds"])
+	assert.Equal(t, "0", got["cyberpower/rack_1/utility_voltage"])
+	assert.Equal(t, "CP1500PFCLCDa", got["cyberpower/rack_1/model_name"])
+	assert.Equal(t, "ON", got["cyberpower/rack_1/on_battery"])
+
+	var config map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(got["homeassistant/sensor/cyberpower_rack_1/battery_capacity/config"]), &config))
+	assert.Equal(t, "battery", config["device_class"])
+	assert.Equal(t, "%", config["unit_of_measurement"])
+	assert.Equal(t, "cyberpower/rack_1/battery_capacity", config["state_topic"])
+	assert.Equal(t, "cyberpower_rack_1_battery_capacity", config["unique_id"])
+	assert.Equal(t, map[string]any{
+		"identifiers":  []any{"cyberpower_rack_1"},
+		"name":         "rack 1",
+		"manufacturer": "CyberPower",
+		"model":        "CP1500PFCLCDa",
+		"sw_version":   "CR01802B7H21",
+	}, config["device"])
+
+	assert.NoError(t, json.Unmarshal([]byte(got["homeassistant/binary_sensor/cyberpower_rack_1/on_battery/config"]), &config))
+	assert.Equal(t, "ON", config["payload_on"])
+
+	// a failed read marks the ups unavailable, closing marks us offline
+	publisher.publishReading(upsReading{ups: "rack 1", err: errors.New("pwrstatd is not running")})
+	publisher.close()
+	assert.Eventually(t, func() bool {
+		got = messages()
+		return got["cyberpower/rack_1/availability"] == "offline" && got["cyberpower/status"] == "offline"
+	}, 5*time.Second, 10*time.Millisecond)
+}
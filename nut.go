@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNUTServer       = errors.New("upsd returned an error")
+	errNUTBadResponse  = errors.New("unexpected response from upsd")
+	errNUTNoUPS        = errors.New("upsd has no UPS configured")
+	errNUTMissingValue = errors.New("variable not reported by upsd")
+)
+
+// nutDefaultTimeout bounds a whole fetch when the context has no deadline.
+const nutDefaultTimeout = 10 * time.Second
+
+// nutTestResults maps ups.test.result onto the strings pwrstat prints.
+// nolint: gochecknoglobals
+var nutTestResults = map[string]string{
+	"Done and passed":   "Passed",
+	"Done and warning":  "Warning",
+	"Done and error":    "Error",
+	"Aborted":           "Aborted",
+	"In progress":       "In progress",
+	"No test initiated": "None",
+}
+
+// nutSource reads a UPS from a NUT upsd server.
+type nutSource struct {
+	addr    string
+	upsName string // if empty the first UPS upsd lists is used
+}
+
+func newNUTSource(addr, upsName string) *nutSource {
+	return &nutSource{addr: addr, upsName: upsName}
+}
+
+func (s *nutSource) Fetch(ctx context.Context) (Device, DeviceStatus, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nutDefaultTimeout)
+		defer cancel()
+	}
+
+	var client, err = dialNUT(ctx, s.addr)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "dialNUT", err: err}
+	}
+	defer client.close()
+
+	var upsName = s.upsName
+	if upsName == "" {
+		names, err := client.listUPS()
+		if err != nil {
+			return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "listUPS", err: err}
+		}
+		if len(names) == 0 {
+			return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "listUPS", err: errNUTNoUPS}
+		}
+		upsName = names[0]
+	}
+
+	// ups.status is asked for on its own first, while the driver cannot
+	// reach the UPS upsd answers it with an error and there is no point in
+	// listing every variable
+	if _, err := client.getVar(upsName, "ups.status"); err != nil {
+		if driverLost(err) {
+			return Device{}, DeviceStatus{State: "Lost Communication", CollectionTime: time.Now()}, nil
+		}
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "getVar", err: err}
+	}
+
+	vars, err := client.listVars(upsName)
+	if err != nil {
+		if driverLost(err) {
+			return Device{}, DeviceStatus{State: "Lost Communication", CollectionTime: time.Now()}, nil
+		}
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "listVars", err: err}
+	}
+
+	device, err := parseNUTDevice(vars)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseDevice, getter: failedGetter(err), err: err}
+	}
+
+	status, err := parseNUTStatus(vars, device)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseStatus, getter: failedGetter(err), err: err}
+	}
+
+	return device, status, nil
+}
+
+// driverLost reports whether upsd answered that its driver cannot reach the
+// UPS, the same situation pwrstat reports as Lost Communication.
+func driverLost(err error) bool {
+	return errors.Is(err, errNUTServer) && (strings.Contains(err.Error(), "DATA-STALE") || strings.Contains(err.Error(), "DRIVER-NOT-CONNECTED"))
+}
+
+// parseNUTDevice maps NUT variables onto Device.
+func parseNUTDevice(vars map[string]string) (Device, error) {
+	var device = Device{
+		ModelName:      firstNonEmpty(vars["ups.model"], vars["device.model"]),
+		FirmwareNumber: vars["ups.firmware"],
+	}
+	var err error
+
+	// ratings are optional in NUT, many drivers do not report them
+	if _, ok := vars["input.voltage.nominal"]; ok {
+		device.RatingVoltage, err = nutInt(vars, "input.voltage.nominal")
+		if err != nil {
+			return Device{}, &getterError{getter: "getRatingVoltage", err: err}
+		}
+	}
+
+	if _, ok := vars["ups.realpower.nominal"]; ok {
+		device.RatingPowerWatts, err = nutInt(vars, "ups.realpower.nominal")
+		if err != nil {
+			return Device{}, &getterError{getter: "getRatingPowerWatts", err: err}
+		}
+	}
+
+	if _, ok := vars["ups.power.nominal"]; ok {
+		device.RatingPowerVA, err = nutInt(vars, "ups.power.nominal")
+		if err != nil {
+			return Device{}, &getterError{getter: "getRatingPowerWatts", err: err}
+		}
+	}
+
+	return device, nil
+}
+
+// parseNUTStatus maps NUT variables onto DeviceStatus.
+func parseNUTStatus(vars map[string]string, device Device) (DeviceStatus, error) {
+	var status = DeviceStatus{}
+	var err error
+
+	var flags, ok = vars["ups.status"]
+	if !ok {
+		return DeviceStatus{}, &getterError{getter: "getState", err: fmt.Errorf("%w: ups.status", errNUTMissingValue)}
+	}
+	var flagSet = map[string]bool{}
+	for _, flag := range strings.Fields(flags) {
+		flagSet[flag] = true
+	}
+
+	switch {
+	case flagSet["OB"]:
+		status.State = "Power Failure"
+		status.PowerSupplyBy = "Battery Power"
+	case flagSet["OL"]:
+		status.State = "Normal"
+		status.PowerSupplyBy = "Utility Power"
+	default:
+		// OFF, BYPASS or CAL without OL or OB, upsd still talks to the UPS
+		// but the flags say nothing about the line, only a stale driver is
+		// Lost Communication
+		status.State = "Unknown"
+	}
+
+	switch {
+	case flagSet["BOOST"]:
+		status.LineInteraction = "Boost"
+	case flagSet["TRIM"]:
+		status.LineInteraction = "Buck"
+	default:
+		status.LineInteraction = "None"
+	}
+
+	status.UtilityVoltage, err = nutInt(vars, "input.voltage")
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getUtilityVoltage", err: err}
+	}
+
+	status.OutputVoltage, err = nutInt(vars, "output.voltage")
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getOutputVoltage", err: err}
+	}
+
+	status.BatteryCapacity, err = nutInt(vars, "battery.charge")
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getBatteryCapacity", err: err}
+	}
+
+	runtime, err := nutInt(vars, "battery.runtime")
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getRemainingRuntime", err: err}
+	}
+	status.RemainingRuntime = time.Duration(runtime) * time.Second
+
+	status.LoadPct, err = nutInt(vars, "ups.load")
+	if err != nil {
+		return DeviceStatus{}, &getterError{getter: "getLoad", err: err}
+	}
+	if _, ok := vars["ups.realpower"]; ok {
+		status.LoadWatts, err = nutInt(vars, "ups.realpower")
+		if err != nil {
+			return DeviceStatus{}, &getterError{getter: "getLoad", err: err}
+		}
+	} else {
+		status.LoadWatts = status.LoadPct * device.RatingPowerWatts / 100
+	}
+
+	status.TestResult = "None"
+	if result, ok := vars["ups.test.result"]; ok {
+		status.TestResult = result
+		if mapped, ok := nutTestResults[result]; ok {
+			status.TestResult = mapped
+		}
+	}
+
+	// upsd keeps no power event log
+	status.LastPowerEvent = "None"
+	status.CollectionTime = time.Now()
+
+	return status, nil
+}
+
+// nutInt parses a numeric NUT variable, drivers often report voltages with a
+// decimal part so it is rounded to the nearest int.
+func nutInt(vars map[string]string, name string) (int, error) {
+	var str, ok = vars[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errNUTMissingValue, name)
+	}
+	var val, err = strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to convert %s: %s to a number, err: %w", name, str, err)
+	}
+	return int(math.Round(val)), nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// nutClient is a minimal client for the upsd network protocol, see
+// https://networkupstools.org/docs/developer-guide.chunked/net-protocol.html
+type nutClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialNUT(ctx context.Context, addr string) (*nutClient, error) {
+	var dialer net.Dialer
+	var conn, err = dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to upsd at %s, err: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return &nutClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *nutClient) close() {
+	_, _ = fmt.Fprint(c.conn, "LOGOUT\n")
+	_ = c.conn.Close()
+}
+
+// list sends a LIST command and returns the fields of every line between
+// BEGIN and END, without the leading "<type> <args...>" prefix.
+func (c *nutClient) list(args ...string) ([][]string, error) {
+	var query = strings.Join(args, " ")
+	if _, err := fmt.Fprintf(c.conn, "LIST %s\n", query); err != nil {
+		return nil, fmt.Errorf("unable to send LIST %s, err: %w", query, err)
+	}
+
+	var line, err = c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line != "BEGIN LIST "+query {
+		return nil, fmt.Errorf("%w: %q", errNUTBadResponse, line)
+	}
+
+	var prefix = len(args) // "UPS", "VAR <ups>"
+	var rows [][]string
+	for {
+		line, err = c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "END LIST "+query {
+			return rows, nil
+		}
+
+		fields, err := splitNUTLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) <= prefix {
+			return nil, fmt.Errorf("%w: %q", errNUTBadResponse, line)
+		}
+		rows = append(rows, fields[prefix:])
+	}
+}
+
+func (c *nutClient) listUPS() ([]string, error) {
+	var rows, err = c.list("UPS")
+	if err != nil {
+		return nil, err
+	}
+	var names = make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row[0])
+	}
+	return names, nil
+}
+
+func (c *nutClient) listVars(upsName string) (map[string]string, error) {
+	var rows, err = c.list("VAR", upsName)
+	if err != nil {
+		return nil, err
+	}
+	var vars = make(map[string]string, len(rows))
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("%w: %q", errNUTBadResponse, strings.Join(row, " "))
+		}
+		vars[row[0]] = row[1]
+	}
+	return vars, nil
+}
+
+// getVar asks upsd for a single variable of a UPS.
+func (c *nutClient) getVar(upsName, name string) (string, error) {
+	var query = upsName + " " + name
+	if _, err := fmt.Fprintf(c.conn, "GET VAR %s\n", query); err != nil {
+		return "", fmt.Errorf("unable to send GET VAR %s, err: %w", query, err)
+	}
+
+	var line, err = c.readLine()
+	if err != nil {
+		return "", err
+	}
+	fields, err := splitNUTLine(line)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 4 || fields[0] != "VAR" || fields[1] != upsName || fields[2] != name {
+		return "", fmt.Errorf("%w: %q", errNUTBadResponse, line)
+	}
+	return fields[3], nil
+}
+
+func (c *nutClient) readLine() (string, error) {
+	var line, err = c.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("unable to read from upsd, err: %w", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "ERR ") {
+		return "", fmt.Errorf("%w: %s", errNUTServer, strings.TrimPrefix(line, "ERR "))
+	}
+	return line, nil
+}
+
+// splitNUTLine splits a protocol line on spaces, honouring double quoted
+// strings and backslash escapes inside them.
+func splitNUTLine(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	var inQuotes, escaped, inField bool
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case r == ' ' && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inQuotes || escaped {
+		return nil, fmt.Errorf("%w: unterminated string in %q", errNUTBadResponse, line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
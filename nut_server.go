@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nutProtocolVersion is the upsd network protocol version we speak.
+const nutProtocolVersion = "1.3"
+
+// nutIdleTimeout closes client connections that stop talking to us. upsmon
+// polls every few seconds so this is generous.
+const nutIdleTimeout = 5 * time.Minute
+
+// statusProvider returns the latest reading of a UPS.
+type statusProvider interface {
+	Latest() (Device, DeviceStatus, error)
+}
+
+// nutServer answers the upsd network protocol so NUT clients (upsmon, NAS
+// boxes, upsc) can monitor the UPSs this exporter reads, allowing this host to
+// be the NUT primary. UPSs are known to clients by their ups name.
+type nutServer struct {
+	upses      map[string]statusProvider
+	lowBattery int // battery.charge at or below which LB is raised
+	username   string
+	password   string
+
+	mu        sync.Mutex
+	numLogins map[string]int
+	fsd       map[string]bool
+}
+
+func newNUTServer(upses map[string]statusProvider, lowBattery int, username, password string) *nutServer {
+	return &nutServer{
+		upses:      upses,
+		lowBattery: lowBattery,
+		username:   username,
+		password:   password,
+		numLogins:  map[string]int{},
+		fsd:        map[string]bool{},
+	}
+}
+
+// Serve accepts connections on listener until it is closed.
+func (s *nutServer) Serve(listener net.Listener) error {
+	for {
+		var conn, err = listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("nut server accept error: %w", err)
+		}
+		go s.handle(conn)
+	}
+}
+
+// nutSession is the per connection state.
+type nutSession struct {
+	username string
+	password string
+	loggedIn string // ups name
+}
+
+func (s *nutServer) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	var session nutSession
+	defer func() {
+		if session.loggedIn != "" {
+			s.mu.Lock()
+			s.numLogins[session.loggedIn]--
+			s.mu.Unlock()
+		}
+	}()
+
+	var reader = bufio.NewReader(conn)
+	for {
+		_ = conn.SetDeadline(time.Now().Add(nutIdleTimeout))
+
+		var line, err = reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields, err := splitNUTLine(strings.TrimRight(line, "\r\n"))
+		if err != nil || len(fields) == 0 {
+			_, _ = fmt.Fprint(conn, "ERR INVALID-ARGUMENT\n")
+			continue
+		}
+
+		var reply, closeConn = s.command(&session, fields)
+		if _, err := fmt.Fprint(conn, reply); err != nil {
+			log.Debugf("nut server write error: %s", err)
+			return
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+// command runs a single protocol command and returns the full reply.
+func (s *nutServer) command(session *nutSession, fields []string) (string, bool) {
+	var args = fields[1:]
+
+	switch strings.ToUpper(fields[0]) {
+	case "VER":
+		return "cyberpower_exporter NUT emulation\n", false
+	case "NETVER":
+		return nutProtocolVersion + "\n", false
+	case "HELP":
+		return "Commands: HELP VER NETVER GET LIST USERNAME PASSWORD LOGIN LOGOUT FSD STARTTLS\n", false
+	case "STARTTLS":
+		return "ERR FEATURE-NOT-CONFIGURED\n", false
+	case "USERNAME":
+		if len(args) != 1 {
+			return "ERR INVALID-ARGUMENT\n", false
+		}
+		session.username = args[0]
+		return "OK\n", false
+	case "PASSWORD":
+		if len(args) != 1 {
+			return "ERR INVALID-ARGUMENT\n", false
+		}
+		session.password = args[0]
+		return "OK\n", false
+	case "LOGIN":
+		return s.login(session, args), false
+	case "FSD":
+		return s.forcedShutdown(session, args), false
+	case "LOGOUT":
+		return "OK Goodbye\n", true
+	case "LIST":
+		return s.list(args), false
+	case "GET":
+		return s.get(args), false
+	default:
+		return "ERR UNKNOWN-COMMAND\n", false
+	}
+}
+
+// authorized reports whether the session may LOGIN or FSD. Without configured
+// credentials anyone may LOGIN, but nobody may FSD.
+func (s *nutServer) authorized(session *nutSession, forFSD bool) bool {
+	if s.username == "" && s.password == "" {
+		return !forFSD
+	}
+	return session.username == s.username && session.password == s.password
+}
+
+func (s *nutServer) login(session *nutSession, args []string) string {
+	if len(args) != 1 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+	if _, ok := s.upses[args[0]]; !ok {
+		return "ERR UNKNOWN-UPS\n"
+	}
+	if session.loggedIn != "" {
+		return "ERR ALREADY-LOGGED-IN\n"
+	}
+	if !s.authorized(session, false) {
+		return "ERR ACCESS-DENIED\n"
+	}
+
+	session.loggedIn = args[0]
+	s.mu.Lock()
+	s.numLogins[args[0]]++
+	s.mu.Unlock()
+	return "OK\n"
+}
+
+func (s *nutServer) forcedShutdown(session *nutSession, args []string) string {
+	if len(args) != 1 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+	if _, ok := s.upses[args[0]]; !ok {
+		return "ERR UNKNOWN-UPS\n"
+	}
+	if !s.authorized(session, true) {
+		return "ERR ACCESS-DENIED\n"
+	}
+
+	s.mu.Lock()
+	s.fsd[args[0]] = true
+	s.mu.Unlock()
+	log.Warnf("nut client %s set forced shutdown on %s", session.username, args[0])
+	return "OK FSD-SET\n"
+}
+
+func (s *nutServer) list(args []string) string {
+	if len(args) == 0 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "UPS":
+		var reply strings.Builder
+		reply.WriteString("BEGIN LIST UPS\n")
+		for _, upsName := range sortedKeys(s.upses) {
+			fmt.Fprintf(&reply, "UPS %s %s\n", upsName, quoteNUT("CyberPower UPS"))
+		}
+		reply.WriteString("END LIST UPS\n")
+		return reply.String()
+	case "VAR":
+		if len(args) != 2 {
+			return "ERR INVALID-ARGUMENT\n"
+		}
+		var upsName = args[1]
+		var vars, errReply = s.vars(upsName)
+		if errReply != "" {
+			return errReply
+		}
+
+		var reply strings.Builder
+		fmt.Fprintf(&reply, "BEGIN LIST VAR %s\n", upsName)
+		for _, name := range sortedKeys(vars) {
+			fmt.Fprintf(&reply, "VAR %s %s %s\n", upsName, name, quoteNUT(vars[name]))
+		}
+		fmt.Fprintf(&reply, "END LIST VAR %s\n", upsName)
+		return reply.String()
+	default:
+		return "ERR INVALID-ARGUMENT\n"
+	}
+}
+
+func (s *nutServer) get(args []string) string {
+	if len(args) < 2 {
+		return "ERR INVALID-ARGUMENT\n"
+	}
+	var upsName = args[1]
+	if _, ok := s.upses[upsName]; !ok {
+		return "ERR UNKNOWN-UPS\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "UPSDESC":
+		return fmt.Sprintf("UPSDESC %s %s\n", upsName, quoteNUT("CyberPower UPS"))
+	case "NUMLOGINS":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return fmt.Sprintf("NUMLOGINS %s %d\n", upsName, s.numLogins[upsName])
+	case "VAR":
+		if len(args) != 3 {
+			return "ERR INVALID-ARGUMENT\n"
+		}
+		var vars, errReply = s.vars(upsName)
+		if errReply != "" {
+			return errReply
+		}
+		var val, ok = vars[args[2]]
+		if !ok {
+			return "ERR VAR-NOT-SUPPORTED\n"
+		}
+		return fmt.Sprintf("VAR %s %s %s\n", upsName, args[2], quoteNUT(val))
+	default:
+		return "ERR INVALID-ARGUMENT\n"
+	}
+}
+
+// vars renders the latest reading of a UPS as NUT variables, or returns the
+// error reply to send if there is no usable reading.
+func (s *nutServer) vars(upsName string) (map[string]string, string) {
+	var provider, ok = s.upses[upsName]
+	if !ok {
+		return nil, "ERR UNKNOWN-UPS\n"
+	}
+
+	var device, status, err = provider.Latest()
+	if err != nil || status.State == "Lost Communication" {
+		return nil, "ERR DATA-STALE\n"
+	}
+
+	s.mu.Lock()
+	var fsd = s.fsd[upsName]
+	s.mu.Unlock()
+
+	return nutVars(device, status, s.lowBattery, fsd), ""
+}
+
+// nutVars maps Device and DeviceStatus onto NUT variables, it is the inverse
+// of parseNUTDevice and parseNUTStatus.
+func nutVars(device Device, status DeviceStatus, lowBattery int, fsd bool) map[string]string {
+	var flags []string
+	if fsd {
+		flags = append(flags, "FSD")
+	}
+	if status.PowerSupplyBy == "Battery Power" {
+		flags = append(flags, "OB", "DISCHRG")
+	} else {
+		flags = append(flags, "OL")
+		if status.BatteryCapacity < 100 {
+			flags = append(flags, "CHRG")
+		}
+	}
+	if status.BatteryCapacity <= lowBattery {
+		flags = append(flags, "LB")
+	}
+	switch status.LineInteraction {
+	case "Boost":
+		flags = append(flags, "BOOST")
+	case "Buck":
+		flags = append(flags, "TRIM")
+	}
+
+	var testResult = "No test initiated"
+	for nut, pwrstat := range nutTestResults {
+		if pwrstat == status.TestResult {
+			testResult = nut
+		}
+	}
+
+	return map[string]string{
+		"battery.charge":        strconv.Itoa(status.BatteryCapacity),
+		"battery.charge.low":    strconv.Itoa(lowBattery),
+		"battery.runtime":       strconv.Itoa(int(status.RemainingRuntime.Seconds())),
+		"device.mfr":            "CyberPower",
+		"device.model":          device.ModelName,
+		"device.type":           "ups",
+		"driver.name":           "cyberpower_exporter",
+		"input.voltage":         strconv.Itoa(status.UtilityVoltage),
+		"input.voltage.nominal": strconv.Itoa(device.RatingVoltage),
+		"output.voltage":        strconv.Itoa(status.OutputVoltage),
+		"ups.firmware":          device.FirmwareNumber,
+		"ups.load":              strconv.Itoa(status.LoadPct),
+		"ups.mfr":               "CyberPower",
+		"ups.model":             device.ModelName,
+		"ups.power.nominal":     strconv.Itoa(device.RatingPowerVA),
+		"ups.realpower":         strconv.Itoa(status.LoadWatts),
+		"ups.realpower.nominal": strconv.Itoa(device.RatingPowerWatts),
+		"ups.status":            strings.Join(flags, " "),
+		"ups.test.result":       testResult,
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteNUT quotes a value for the upsd protocol.
+func quoteNUT(val string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val) + `"`
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStatusProvider struct {
+	device Device
+	status DeviceStatus
+	err    error
+}
+
+func (p *fakeStatusProvider) Latest() (Device, DeviceStatus, error) {
+	return p.device, p.status, p.err
+}
+
+func newFakeStatusProvider(t *testing.T, out string) *fakeStatusProvider {
+	t.Helper()
+
+	var device, status, err = fakePwrstatSource(out, nil).Fetch(context.Background())
+	assert.NoError(t, err)
+	return &fakeStatusProvider{device: device, status: status}
+}
+
+func startNUTServer(t *testing.T, server *nutServer) string {
+	t.Helper()
+
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() { _ = server.Serve(listener) }()
+	return listener.Addr().String()
+}
+
+// nutConversation sends each command and returns the first reply line of each.
+func nutConversation(t *testing.T, addr string, commands ...string) []string {
+	t.Helper()
+
+	var conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var reader = bufio.NewReader(conn)
+	var replies = make([]string, 0, len(commands))
+	for _, command := range commands {
+		_, err = fmt.Fprintf(conn, "%s\n", command)
+		assert.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		replies = append(replies, line[:len(line)-1])
+	}
+	return replies
+}
+
+func TestNUTServerRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var provider = newFakeStatusProvider(t, testOutputNormal)
+	var addr = startNUTServer(t, newNUTServer(map[string]statusProvider{"cyberpower": provider}, 10, "", ""))
+
+	// our own NUT client must read back what the server was given
+	var device, status, err = newNUTSource(addr, "").Fetch(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, provider.device, device)
+	assert.Equal(t, provider.status.State, status.State)
+	assert.Equal(t, provider.status.PowerSupplyBy, status.PowerSupplyBy)
+	assert.Equal(t, provider.status.UtilityVoltage, status.UtilityVoltage)
+	assert.Equal(t, provider.status.OutputVoltage, status.OutputVoltage)
+	assert.Equal(t, provider.status.BatteryCapacity, status.BatteryCapacity)
+	assert.Equal(t, provider.status.RemainingRuntime, status.RemainingRuntime)
+	assert.Equal(t, provider.status.LoadWatts, status.LoadWatts)
+	assert.Equal(t, provider.status.LoadPct, status.LoadPct)
+	assert.Equal(t, provider.status.LineInteraction, status.LineInteraction)
+	assert.Equal(t, provider.status.TestResult, status.TestResult)
+}
+
+func TestNUTServerCommands(t *testing.T) {
+	t.Parallel()
+
+	var provider = newFakeStatusProvider(t, testOutputBlackout)
+	var addr = startNUTServer(t, newNUTServer(map[string]statusProvider{"cyberpower": provider}, 40, "upsmon", "secret"))
+
+	assert.Equal(t, []string{
+		`VAR cyberpower ups.status "OB DISCHRG LB"`,
+		`VAR cyberpower battery.charge "39"`,
+		`ERR VAR-NOT-SUPPORTED`,
+		`ERR UNKNOWN-UPS`,
+		`ERR UNKNOWN-COMMAND`,
+		`1.3`,
+	}, nutConversation(t, addr,
+		"GET VAR cyberpower ups.status",
+		"GET VAR cyberpower battery.charge",
+		"GET VAR cyberpower ups.nope",
+		"GET VAR other ups.status",
+		"BOGUS",
+		"NETVER",
+	))
+
+	// wrong password, then a primary login that sets FSD
+	assert.Equal(t, []string{
+		"OK", "OK", "ERR ACCESS-DENIED", "ERR ACCESS-DENIED",
+		"OK", "OK", "ERR ALREADY-LOGGED-IN", "NUMLOGINS cyberpower 1", "OK FSD-SET",
+		`VAR cyberpower ups.status "FSD OB DISCHRG LB"`,
+		"OK Goodbye",
+	}, nutConversation(t, addr,
+		"USERNAME upsmon", "PASSWORD wrong", "LOGIN cyberpower", "FSD cyberpower",
+		`PASSWORD "secret"`, "LOGIN cyberpower", "LOGIN cyberpower", "GET NUMLOGINS cyberpower", "FSD cyberpower",
+		"GET VAR cyberpower ups.status",
+		"LOGOUT",
+	))
+}
+
+func TestNUTServerNoCredentials(t *testing.T) {
+	t.Parallel()
+
+	var provider = newFakeStatusProvider(t, testOutputNormal)
+	var addr = startNUTServer(t, newNUTServer(map[string]statusProvider{"cyberpower": provider}, 10, "", ""))
+
+	assert.Equal(t, []string{"OK", "ERR ACCESS-DENIED"}, nutConversation(t, addr, "LOGIN cyberpower", "FSD cyberpower"))
+}
+
+func TestNUTServerStale(t *testing.T) {
+	t.Parallel()
+
+	var provider = &fakeStatusProvider{err: errors.New("pwrstatd is not running")}
+	var addr = startNUTServer(t, newNUTServer(map[string]statusProvider{"cyberpower": provider}, 10, "", ""))
+
+	assert.Equal(t, []string{"ERR DATA-STALE", "ERR DATA-STALE"}, nutConversation(t, addr,
+		"GET VAR cyberpower ups.status",
+		"LIST VAR cyberpower",
+	))
+
+	provider = newFakeStatusProvider(t, testLostConnection)
+	addr = startNUTServer(t, newNUTServer(map[string]statusProvider{"cyberpower": provider}, 10, "", ""))
+	assert.Equal(t, []string{"ERR DATA-STALE"}, nutConversation(t, addr, "GET VAR cyberpower ups.status"))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nolint: gochecknoglobals
+var testNUTVarsNormal = map[string]string{
+	"battery.charge":        "46",
+	"battery.runtime":       "1680",
+	"device.model":          "CP1500PFCLCD",
+	"input.voltage":         "122.0",
+	"input.voltage.nominal": "120",
+	"output.voltage":        "122.0",
+	"ups.firmware":          "CR01802B7H21",
+	"ups.load":              "12",
+	"ups.model":             "CP1500PFCLCD",
+	"ups.power.nominal":     "1500",
+	"ups.realpower.nominal": "1000",
+	"ups.status":            "OL CHRG",
+	"ups.test.result":       "Done and passed",
+}
+
+// fakeUPSD is an in-process upsd that serves a fixed set of variables, or an
+// error for LIST VAR and GET VAR if listVarErr is set.
+func fakeUPSD(t *testing.T, upsName string, vars map[string]string, listVarErr string) string {
+	t.Helper()
+
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeUPSD(conn, upsName, vars, listVarErr)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveFakeUPSD(conn net.Conn, upsName string, vars map[string]string, listVarErr string) {
+	defer func() { _ = conn.Close() }()
+
+	var scanner = bufio.NewScanner(conn)
+	for scanner.Scan() {
+		switch line := scanner.Text(); line {
+		case "LIST UPS":
+			_, _ = fmt.Fprintf(conn, "BEGIN LIST UPS\nUPS %s \"CyberPower \\\"test\\\" UPS\"\nEND LIST UPS\n", upsName)
+		case "LIST VAR " + upsName:
+			if listVarErr != "" {
+				_, _ = fmt.Fprintf(conn, "ERR %s\n", listVarErr)
+				continue
+			}
+			var names = make([]string, 0, len(vars))
+			for name := range vars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			_, _ = fmt.Fprintf(conn, "BEGIN LIST VAR %s\n", upsName)
+			for _, name := range names {
+				_, _ = fmt.Fprintf(conn, "VAR %s %s \"%s\"\n", upsName, name, vars[name])
+			}
+			_, _ = fmt.Fprintf(conn, "END LIST VAR %s\n", upsName)
+		case "LOGOUT":
+			_, _ = fmt.Fprint(conn, "OK Goodbye\n")
+			return
+		default:
+			if query, found := strings.CutPrefix(line, "GET VAR "+upsName+" "); found {
+				var val, ok = vars[query]
+				switch {
+				case listVarErr != "":
+					_, _ = fmt.Fprintf(conn, "ERR %s\n", listVarErr)
+				case !ok:
+					_, _ = fmt.Fprint(conn, "ERR VAR-NOT-SUPPORTED\n")
+				default:
+					_, _ = fmt.Fprintf(conn, "VAR %s %s \"%s\"\n", upsName, query, val)
+				}
+				continue
+			}
+			if strings.HasPrefix(line, "LIST VAR ") || strings.HasPrefix(line, "GET VAR ") {
+				_, _ = fmt.Fprint(conn, "ERR UNKNOWN-UPS\n")
+				continue
+			}
+			_, _ = fmt.Fprint(conn, "ERR UNKNOWN-COMMAND\n")
+		}
+	}
+}
+
+func TestNUTSourceNormal(t *testing.T) {
+	t.Parallel()
+
+	var addr = fakeUPSD(t, "cyberpower", testNUTVarsNormal, "")
+
+	for _, upsName := range []string{"cyberpower", ""} {
+		var device, status, err = newNUTSource(addr, upsName).Fetch(context.Background())
+		assert.NoError(t, err)
+
+		assert.Equal(t, "CP1500PFCLCD", device.ModelName)
+		assert.Equal(t, "CR01802B7H21", device.FirmwareNumber)
+		assert.Equal(t, 120, device.RatingVoltage)
+		assert.Equal(t, 1000, device.RatingPowerWatts)
+		assert.Equal(t, 1500, device.RatingPowerVA)
+
+		assert.Equal(t, "Normal", status.State)
+		assert.Equal(t, "Utility Power", status.PowerSupplyBy)
+		assert.Equal(t, 122, status.UtilityVoltage)
+		assert.Equal(t, 122, status.OutputVoltage)
+		assert.Equal(t, 46, status.BatteryCapacity)
+		assert.Equal(t, time.Duration(28)*time.Minute, status.RemainingRuntime)
+		assert.Equal(t, 120, status.LoadWatts)
+		assert.Equal(t, 12, status.LoadPct)
+		assert.Equal(t, "None", status.LineInteraction)
+		assert.Equal(t, "Passed", status.TestResult)
+	}
+}
+
+func TestNUTSourceBlackout(t *testing.T) {
+	t.Parallel()
+
+	var vars = map[string]string{}
+	for name, val := range testNUTVarsNormal {
+		vars[name] = val
+	}
+	vars["ups.status"] = "OB DISCHRG BOOST"
+	vars["input.voltage"] = "0.0"
+	vars["battery.charge"] = "39"
+	vars["ups.realpower"] = "118"
+
+	var _, status, err = newNUTSource(fakeUPSD(t, "cyberpower", vars, ""), "cyberpower").Fetch(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Power Failure", status.State)
+	assert.Equal(t, "Battery Power", status.PowerSupplyBy)
+	assert.Equal(t, 0, status.UtilityVoltage)
+	assert.Equal(t, 39, status.BatteryCapacity)
+	assert.Equal(t, 118, status.LoadWatts)
+	assert.Equal(t, "Boost", status.LineInteraction)
+}
+
+func TestNUTSourceUnknownState(t *testing.T) {
+	t.Parallel()
+
+	for _, flags := range []string{"OFF", "BYPASS", "CAL"} {
+		var vars = map[string]string{}
+		for name, val := range testNUTVarsNormal {
+			vars[name] = val
+		}
+		vars["ups.status"] = flags
+
+		var _, status, err = newNUTSource(fakeUPSD(t, "cyberpower", vars, ""), "cyberpower").Fetch(context.Background())
+		assert.NoError(t, err, flags)
+
+		assert.Equal(t, "Unknown", status.State, flags)
+		assert.Empty(t, status.PowerSupplyBy, flags)
+		assert.Equal(t, 122, status.UtilityVoltage, flags)
+		assert.False(t, status.CollectionTime.IsZero(), flags)
+	}
+}
+
+func TestNUTSourceErrors(t *testing.T) {
+	t.Parallel()
+
+	var _, status, err = newNUTSource(fakeUPSD(t, "cyberpower", nil, "DATA-STALE"), "cyberpower").Fetch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Lost Communication", status.State)
+
+	var sErr *scrapeError
+	_, _, err = newNUTSource(fakeUPSD(t, "cyberpower", nil, ""), "nope").Fetch(context.Background())
+	assert.ErrorIs(t, err, errNUTServer)
+	assert.ErrorAs(t, err, &sErr)
+	assert.Equal(t, "getVar", sErr.getter)
+
+	var vars = map[string]string{}
+	for name, val := range testNUTVarsNormal {
+		vars[name] = val
+	}
+	delete(vars, "ups.load")
+	_, _, err = newNUTSource(fakeUPSD(t, "cyberpower", vars, ""), "cyberpower").Fetch(context.Background())
+	assert.ErrorIs(t, err, errNUTMissingValue)
+	assert.ErrorAs(t, err, &sErr)
+	assert.Equal(t, stageParseStatus, sErr.stage)
+	assert.Equal(t, "getLoad", sErr.getter)
+}
+
+func TestNUTClientGetVar(t *testing.T) {
+	t.Parallel()
+
+	var client, err = dialNUT(context.Background(), fakeUPSD(t, "cyberpower", testNUTVarsNormal, ""))
+	assert.NoError(t, err)
+	defer client.close()
+
+	val, err := client.getVar("cyberpower", "ups.status")
+	assert.NoError(t, err)
+	assert.Equal(t, "OL CHRG", val)
+
+	_, err = client.getVar("cyberpower", "ups.beeper.status")
+	assert.ErrorIs(t, err, errNUTServer)
+	assert.ErrorContains(t, err, "VAR-NOT-SUPPORTED")
+
+	_, err = client.getVar("nope", "ups.status")
+	assert.ErrorContains(t, err, "UNKNOWN-UPS")
+
+	// the connection is still usable after an error
+	val, err = client.getVar("cyberpower", "battery.charge")
+	assert.NoError(t, err)
+	assert.Equal(t, "46", val)
+}
+
+func TestSplitNUTLine(t *testing.T) {
+	t.Parallel()
+
+	var fields, err = splitNUTLine(`VAR cyberpower ups.mfr "CPS \"Cyber\" Power\\"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VAR", "cyberpower", "ups.mfr", `CPS "Cyber" Power\`}, fields)
+
+	fields, err = splitNUTLine(`VAR cyberpower ups.serial ""`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VAR", "cyberpower", "ups.serial", ""}, fields)
+
+	_, err = splitNUTLine(`VAR cyberpower ups.mfr "CPS`)
+	assert.ErrorIs(t, err, errNUTBadResponse)
+}
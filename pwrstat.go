@@ -2,21 +2,41 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var (
+	errPwrstatTimeout       = errors.New("pwrstat timed out")
+	errPwrstatBusy          = errors.New("the last pwrstat is still running")
 	errUnknownDurationUnit  = errors.New("event duration has an unknown unit")
 	errGroupIDExceedsLength = errors.New("groupID exceeds array length")
 	errNoMatchesFound       = errors.New("could not find any matches")
 )
 
+// getterError records which getter failed while parsing pwrstat output.
+type getterError struct {
+	getter string
+	err    error
+}
+
+func (e *getterError) Error() string {
+	return e.getter + " err: " + e.err.Error()
+}
+
+func (e *getterError) Unwrap() error {
+	return e.err
+}
+
 type Device struct {
 	ModelName        string
 	FirmwareNumber   string
@@ -52,8 +72,8 @@ var batteryCapacityRegex = regexp.MustCompile(`Battery Capacity\.+\s(\d+)\s\%\n`
 var remainingRuntimeRegex = regexp.MustCompile(`Remaining Runtime\.+\s(\d{1,3})\smin\.\n`)
 var loadRegex = regexp.MustCompile(`Load\.+\s(\d+)\sWatt\((\d+)\s\%\)\n`)
 var lineInteractionRegex = regexp.MustCompile(`Line Interaction\.+\s([a-zA-Z]+)\n`)
-var testResultRegex = regexp.MustCompile(`Test Result\.+\s([a-zA-Z]+)\sat\s(.*)\n`)
-var lastPowerEventRegex = regexp.MustCompile(`Last Power Event\.+\s([a-zA-Z]+)\sat\s(\d+\/\d+\/\d+\s+\d+\:\d+\d\:\d+)(?:\sfor\s(\d+)\s([a-zA-Z]+)\.|\n)`)
+var testResultRegex = regexp.MustCompile(`Test Result\.+\s([a-zA-Z ]+?)(?:\sat\s(.*))?\n`)
+var lastPowerEventRegex = regexp.MustCompile(`Last Power Event\.+\s([a-zA-Z ]+?)\sat\s(\d+\/\d+\/\d+\s+\d+\:\d+\d\:\d+)(?:\sfor\s(\d+)\s([a-zA-Z]+)\.|\n)`)
 
 // regexs for Device.
 var modelNameRegex = regexp.MustCompile(`Model Name\.+\s([a-zA-Z0-9]+)`)
@@ -61,9 +81,94 @@ var firmwareNumberRegex = regexp.MustCompile(`Firmware Number\.+\s([a-zA-Z0-9]+)
 var ratingVoltageRegex = regexp.MustCompile(`Rating Voltage\.+\s(\d+)\sV`)
 var ratingPowerWattsRegex = regexp.MustCompile(`Rating Power\.+\s(\d+)\sWatt\((\d+)\sVA\)`)
 
-func getPowerStats(cmdPath string) (string, error) {
+// defaultExecTimeout is how long pwrstat may run if no -exec-timeout is set.
+const defaultExecTimeout = 10 * time.Second
+
+// pwrstatSource reads the UPS by running pwrstat and parsing its output. A
+// pwrstat that runs past timeout is killed along with its children. If one
+// cannot be killed, reads fail fast until it is gone rather than pile up
+// more hung processes. If recorder is set every output is saved with it.
+type pwrstatSource struct {
+	cmdPath  string
+	timeout  time.Duration
+	getStats func(ctx context.Context, cmdPath string) (string, error)
+	recorder *captureRecorder
+	running  atomic.Bool
+}
+
+func newPwrstatSource(cmdPath string, timeout time.Duration) *pwrstatSource {
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	return &pwrstatSource{cmdPath: cmdPath, timeout: timeout, getStats: getPowerStats}
+}
+
+// pwrstatResult is the output of a pwrstat run.
+type pwrstatResult struct {
+	out string
+	err error
+}
+
+func (s *pwrstatSource) Fetch(ctx context.Context) (Device, DeviceStatus, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExecBusy, getter: "getPowerStats", err: errPwrstatBusy}
+	}
+
+	var execCtx, cancel = context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var result = make(chan pwrstatResult, 1)
+	go func() {
+		defer s.running.Store(false)
+		var out, err = s.getStats(execCtx, s.cmdPath)
+		result <- pwrstatResult{out: out, err: err}
+	}()
+
+	var out string
+	select {
+	case <-execCtx.Done():
+		if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return Device{}, DeviceStatus{}, &scrapeError{stage: stageExecTimeout, getter: "getPowerStats",
+				err: fmt.Errorf("%w after %s", errPwrstatTimeout, s.timeout)}
+		}
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "getPowerStats", err: execCtx.Err()}
+	case r := <-result:
+		if r.err != nil {
+			return Device{}, DeviceStatus{}, &scrapeError{stage: stageExec, getter: "getPowerStats", err: r.err}
+		}
+		out = r.out
+	}
+
+	if s.recorder != nil {
+		if err := s.recorder.record(time.Now(), out); err != nil {
+			log.Warnf("unable to record pwrstat output, err: %s", err)
+		}
+	}
+
+	return parsePwrstatOutput(out)
+}
+
+// parsePwrstatOutput parses the output of pwrstat -status.
+func parsePwrstatOutput(out string) (Device, DeviceStatus, error) {
+	var status, err = parsePowerStatus(out)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseStatus, getter: failedGetter(err), err: err}
+	}
+
+	device, err := parseDeviceProperties(out)
+	if err != nil {
+		return Device{}, DeviceStatus{}, &scrapeError{stage: stageParseDevice, getter: failedGetter(err), err: err}
+	}
 
-	var cmd = exec.Command(cmdPath, "-status")
+	return device, status, nil
+}
+
+func getPowerStats(ctx context.Context, cmdPath string) (string, error) {
+
+	var cmd = exec.CommandContext(ctx, cmdPath, "-status")
+	killProcessGroupOnCancel(cmd)
+	// do not wait on children that hold the output open
+	cmd.WaitDelay = time.Second
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
@@ -78,21 +183,23 @@ func getPowerStats(cmdPath string) (string, error) {
 
 func parsePowerStatus(cmdOutput string) (DeviceStatus, error) {
 	var err error
-	var status = DeviceStatus{}
+	// set before the Lost Communication return below, readings of a lost
+	// UPS need a time too
+	var status = DeviceStatus{CollectionTime: time.Now()}
 
 	status.State, err = getState(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getState err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getState", err: err}
 	}
 
 	status.TestResult, status.TestResultTime, err = getTestResult(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getTestResult err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getTestResult", err: err}
 	}
 
 	status.LastPowerEvent, status.LastPowerEventTime, status.LastPowerEventDuration, err = getLastPowerEvent(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getLastPowerEvent err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getLastPowerEvent", err: err}
 	}
 
 	// if we lost communication, we dont need to parse the rest.
@@ -103,40 +210,39 @@ func parsePowerStatus(cmdOutput string) (DeviceStatus, error) {
 
 	status.PowerSupplyBy, err = getPowerSupply(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getPowerSupply err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getPowerSupply", err: err}
 	}
 
 	status.LineInteraction, err = getLineInteraction(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getLineInteraction err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getLineInteraction", err: err}
 	}
 
 	status.UtilityVoltage, err = getUtilityVoltage(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getUtilityVoltage err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getUtilityVoltage", err: err}
 	}
 
 	status.OutputVoltage, err = getOutputVoltage(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getOutputVoltage err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getOutputVoltage", err: err}
 	}
 
 	status.BatteryCapacity, err = getBatteryCapacity(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getBatteryCapacity err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getBatteryCapacity", err: err}
 	}
 
 	status.RemainingRuntime, err = getRemainingRuntime(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getRemainingRuntime err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getRemainingRuntime", err: err}
 	}
 
 	status.LoadWatts, status.LoadPct, err = getLoad(cmdOutput)
 	if err != nil {
-		return DeviceStatus{}, fmt.Errorf("getLoad err: %w", err)
+		return DeviceStatus{}, &getterError{getter: "getLoad", err: err}
 	}
 
-	status.CollectionTime = time.Now()
 	return status, nil
 }
 
@@ -147,22 +253,22 @@ func parseDeviceProperties(cmdOutput string) (Device, error) {
 
 	device.ModelName, err = getModelName(cmdOutput)
 	if err != nil {
-		return Device{}, fmt.Errorf("getModelName err: %w", err)
+		return Device{}, &getterError{getter: "getModelName", err: err}
 	}
 
 	device.FirmwareNumber, err = getFirmwareNumber(cmdOutput)
 	if err != nil {
-		return Device{}, fmt.Errorf("getFirmwareNumber err: %w", err)
+		return Device{}, &getterError{getter: "getFirmwareNumber", err: err}
 	}
 
 	device.RatingVoltage, err = getRatingVoltage(cmdOutput)
 	if err != nil {
-		return Device{}, fmt.Errorf("getRatingVoltage err: %w", err)
+		return Device{}, &getterError{getter: "getRatingVoltage", err: err}
 	}
 
 	device.RatingPowerWatts, device.RatingPowerVA, err = getRatingPowerWatts(cmdOutput)
 	if err != nil {
-		return Device{}, fmt.Errorf("getRatingPowerWatts err: %w", err)
+		return Device{}, &getterError{getter: "getRatingPowerWatts", err: err}
 	}
 
 	return device, nil
@@ -249,8 +355,12 @@ func getTestResult(input string) (string, time.Time, error) {
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("unable to find the last test result date, err: %w", err)
 	}
+	// a test that is still running or never ran has no date
+	if dateStr == "" {
+		return result, time.Time{}, nil
+	}
 
-	date, err := time.Parse(dateFormat, dateStr)
+	date, err := time.ParseInLocation(dateFormat, dateStr, time.Local)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("unable to pasre date: %s, err: %w", dateStr, err)
 	}
@@ -275,7 +385,7 @@ func getLastPowerEvent(input string) (string, time.Time, time.Duration, error) {
 		return "", time.Time{}, 0, fmt.Errorf("unable to find the last power event, err: %w", err)
 	}
 
-	date, err := time.Parse(dateFormat, dateStr)
+	date, err := time.ParseInLocation(dateFormat, dateStr, time.Local)
 	if err != nil {
 		return "", time.Time{}, 0, fmt.Errorf("unable to parse date: %s, err: %w", dateStr, err)
 	}
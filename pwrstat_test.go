@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// testLocation is the zone the tests run in. pwrstat prints local times
+// without a zone, a fixed one keeps the expected unix times the same on any
+// machine.
+// nolint: gochecknoglobals
+var testLocation = time.FixedZone("EST", -5*60*60)
+
+func TestMain(m *testing.M) {
+	time.Local = testLocation
+	os.Exit(m.Run())
+}
+
 // nolint: gochecknoglobals
 var (
 	testOutputNormal = `
@@ -92,6 +106,32 @@ func TestParsePowerStatusNormal(t *testing.T) {
 	assert.Equal(t, time.Duration(3)*time.Second, status.LastPowerEventDuration)
 }
 
+func TestParsePowerStatusLastPowerEvent(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		line     string
+		event    string
+		duration time.Duration
+	}{
+		{"Last Power Event............. Under Voltage at 2023/03/09 12:55:09 for 12 sec.\n", "Under Voltage", 12 * time.Second},
+		{"Last Power Event............. Under Voltage at 2023/03/09 12:55:09\n", "Under Voltage", 0},
+		{"Last Power Event............. Over Voltage at 2023/03/09 12:55:09 for 2 min.\n", "Over Voltage", 2 * time.Minute},
+		{"Last Power Event............. Over Voltage at 2023/03/09 12:55:09\n", "Over Voltage", 0},
+	}
+
+	for _, test := range tests {
+		var output = strings.Replace(testOutputNormal, "Last Power Event............. Blackout at 2023/03/09 12:55:09 for 3 sec.\n", test.line, 1)
+
+		var status, err = parsePowerStatus(output)
+		assert.NoError(t, err, test.line)
+
+		assert.Equal(t, test.event, status.LastPowerEvent, test.line)
+		assert.Equal(t, time.Date(2023, time.March, 9, 12, 55, 9, 0, testLocation), status.LastPowerEventTime, test.line)
+		assert.Equal(t, test.duration, status.LastPowerEventDuration, test.line)
+	}
+}
+
 func TestParsePowerStatusBlackout(t *testing.T) {
 	t.Parallel()
 
@@ -174,3 +214,30 @@ func TestParseDevicePropertiesLostConn(t *testing.T) {
 	assert.Equal(t, 1000, device.RatingPowerWatts)
 	assert.Equal(t, 1500, device.RatingPowerVA)
 }
+
+func TestPwrstatSourceBusy(t *testing.T) {
+	t.Parallel()
+
+	// a pwrstat that cannot be killed, it ignores its context
+	var release = make(chan struct{})
+	var source = newPwrstatSource("pwrstat", 10*time.Millisecond)
+	source.getStats = func(context.Context, string) (string, error) {
+		<-release
+		return testOutputNormal, nil
+	}
+
+	var _, _, err = source.Fetch(context.Background())
+	assert.ErrorIs(t, err, errPwrstatTimeout)
+
+	// no second one is started while it hangs
+	_, _, err = source.Fetch(context.Background())
+	var sErr *scrapeError
+	assert.ErrorAs(t, err, &sErr)
+	assert.Equal(t, stageExecBusy, sErr.stage)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		var _, _, err = source.Fetch(context.Background())
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
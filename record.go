@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureTimeFormat names capture files by the UTC time they were taken, so
+// they sort in the order they were taken.
+const captureTimeFormat = "20060102T150405.000000000Z"
+
+// captureExt is the extension of capture files.
+const captureExt = ".txt"
+
+// defaultRecordKeep is how many captures of a UPS are kept if no -record-keep
+// is set.
+const defaultRecordKeep = 1000
+
+// captureRecorder saves the raw output of pwrstat to dir, one file per run,
+// so it can be attached to bug reports and fed back with -source replay.
+// Output identical to the last capture is not saved again, and only the keep
+// newest captures are kept.
+type captureRecorder struct {
+	dir  string
+	keep int
+
+	mu     sync.Mutex
+	loaded bool
+	last   string
+}
+
+func newCaptureRecorder(dir string, keep int) *captureRecorder {
+	if keep <= 0 {
+		keep = defaultRecordKeep
+	}
+	return &captureRecorder{dir: dir, keep: keep}
+}
+
+// record saves out as taken at at, unless it is the same as the last capture.
+func (r *captureRecorder) record(at time.Time, out string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// pick up where an earlier run left off
+	if !r.loaded {
+		if err := os.MkdirAll(r.dir, 0o750); err != nil {
+			return fmt.Errorf("unable to create record dir: %s, err: %w", r.dir, err)
+		}
+		var names, err = captureNames(r.dir)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			last, err := os.ReadFile(filepath.Join(r.dir, names[len(names)-1]))
+			if err != nil {
+				return fmt.Errorf("unable to read last capture, err: %w", err)
+			}
+			r.last = string(last)
+		}
+		r.loaded = true
+	}
+
+	if out == r.last {
+		return nil
+	}
+
+	var path = filepath.Join(r.dir, at.UTC().Format(captureTimeFormat)+captureExt)
+	if err := os.WriteFile(path, []byte(out), 0o600); err != nil {
+		return fmt.Errorf("unable to write capture: %s, err: %w", path, err)
+	}
+	r.last = out
+
+	return r.rotate()
+}
+
+// rotate removes the oldest captures beyond keep.
+func (r *captureRecorder) rotate() error {
+	var names, err = captureNames(r.dir)
+	if err != nil {
+		return err
+	}
+	for len(names) > r.keep {
+		if err := os.Remove(filepath.Join(r.dir, names[0])); err != nil {
+			return fmt.Errorf("unable to remove old capture: %s, err: %w", names[0], err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// captureNames returns the names of the capture files in dir, oldest first.
+// Other files are left alone.
+func captureNames(dir string) ([]string, error) {
+	var entries, err = os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read record dir: %s, err: %w", dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, ok := captureTime(entry.Name()); ok && entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// captureTime returns the time a capture file was taken, from its name.
+func captureTime(name string) (time.Time, bool) {
+	var stamp, found = strings.CutSuffix(filepath.Base(name), captureExt)
+	if !found {
+		return time.Time{}, false
+	}
+	var at, err = time.Parse(captureTimeFormat, stamp)
+	return at, err == nil
+}
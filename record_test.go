@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureRecorder(t *testing.T) {
+	t.Parallel()
+
+	var dir = filepath.Join(t.TempDir(), "rack1")
+	var recorder = newCaptureRecorder(dir, 2)
+	var start = time.Date(2026, time.October, 17, 18, 15, 19, 0, time.UTC)
+
+	assert.NoError(t, recorder.record(start, testOutputNormal))
+	// the same output again is not saved
+	assert.NoError(t, recorder.record(start.Add(time.Second), testOutputNormal))
+	names, err := captureNames(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20261017T181519.000000000Z.txt"}, names)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep me"), 0o600))
+	assert.NoError(t, recorder.record(start.Add(2*time.Second), testOutputBlackout))
+	assert.NoError(t, recorder.record(start.Add(3*time.Second), testLostConnection))
+
+	// the oldest is rotated out, other files are left alone
+	names, err = captureNames(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20261017T181521.000000000Z.txt", "20261017T181522.000000000Z.txt"}, names)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	assert.NoError(t, err)
+
+	// a new recorder carries on from the last capture
+	recorder = newCaptureRecorder(dir, 2)
+	assert.NoError(t, recorder.record(start.Add(4*time.Second), testLostConnection))
+	names, err = captureNames(dir)
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+
+	out, err := os.ReadFile(filepath.Join(dir, names[1]))
+	assert.NoError(t, err)
+	assert.Equal(t, testLostConnection, string(out))
+}
+
+func TestPwrstatSourceRecords(t *testing.T) {
+	t.Parallel()
+
+	var dir = t.TempDir()
+	var source = fakePwrstatSource("garbage", nil)
+	source.recorder = newCaptureRecorder(dir, 0)
+
+	// output that does not parse is recorded too, it is what a bug report needs
+	var _, _, err = source.Fetch(context.Background())
+	assert.Error(t, err)
+
+	names, err := captureNames(dir)
+	assert.NoError(t, err)
+	assert.Len(t, names, 1)
+	out, err := os.ReadFile(filepath.Join(dir, names[0]))
+	assert.NoError(t, err)
+	assert.Equal(t, "garbage", string(out))
+}
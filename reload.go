@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// nolint: gochecknoglobals
+var (
+	reloadSuccessfulDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "config_last_reload_successful"),
+		"1 if the last reload of the -config file succeeded, 0 otherwise",
+		nil, nil,
+	)
+
+	reloadTimestampDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "config_last_reload_success_timestamp_seconds"),
+		"unix time the -config file was last loaded successfully",
+		nil, nil,
+	)
+)
+
+// reloader reloads the -config file on SIGHUP and POST /-/reload. UPS sources
+// and intervals, the energy price, alerts and webhooks change in place, the
+// monitors keep their totals. Other changes, the listen addresses, state
+// file, outputs other than webhooks and adding or removing UPSs, are logged
+// and need a restart. It is a prometheus.Collector for the reload results.
+type reloader struct {
+	path     string
+	base     configFile // from the flags, the file is decoded on top of it
+	monitors map[string]*upsMonitor
+	engines  map[string]*shutdownEngine
+	events   *eventDetector
+	notifier *webhookNotifier
+
+	mu          sync.Mutex
+	current     configFile
+	successful  bool
+	lastSuccess time.Time
+}
+
+func newReloader(path string, base, current configFile, monitors []*upsMonitor,
+	engines map[string]*shutdownEngine, events *eventDetector, notifier *webhookNotifier) *reloader {
+	var byName = make(map[string]*upsMonitor, len(monitors))
+	for _, monitor := range monitors {
+		byName[monitor.name] = monitor
+	}
+
+	return &reloader{
+		path:        path,
+		base:        base,
+		monitors:    byName,
+		engines:     engines,
+		events:      events,
+		notifier:    notifier,
+		current:     current,
+		successful:  true,
+		lastSuccess: time.Now(),
+	}
+}
+
+// reload loads the config file and applies it. A config that does not load
+// or validate is not applied at all.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err = r.apply()
+	r.successful = err == nil
+	if err != nil {
+		log.Errorf("unable to reload config: %s", err)
+		return err
+	}
+	r.lastSuccess = time.Now()
+	log.Infof("reloaded config %s", r.path)
+	return nil
+}
+
+// apply loads and applies the config file. Everything that can fail is built
+// before anything is changed, so a config is applied fully or not at all.
+// The caller must hold r.mu.
+func (r *reloader) apply() error {
+	var config, err = loadConfigFile(r.path, r.base)
+	if err != nil {
+		return err
+	}
+	// both were validated, these cannot fail
+	var upsConfigs, _ = config.upsConfigs()
+	var currentUPS, _ = r.current.upsConfigs()
+	webhooks, err := config.webhookConfig()
+	if err != nil {
+		return err
+	}
+	webhookTemplate, err := parseWebhookTemplate(webhooks.template)
+	if err != nil {
+		return err
+	}
+
+	var previous = make(map[string]upsConfig, len(currentUPS))
+	for _, ups := range currentUPS {
+		previous[ups.name] = ups
+	}
+	var sources = map[string]Source{}
+	for _, ups := range upsConfigs {
+		if _, ok := r.monitors[ups.name]; !ok || ups == previous[ups.name] {
+			continue
+		}
+		var source, err = newSource(ups.kind, ups.source)
+		if err != nil {
+			return fmt.Errorf("ups %s: %w", ups.name, err)
+		}
+		sources[ups.name] = source
+	}
+
+	r.warnRestart(config, currentUPS, upsConfigs)
+
+	for _, ups := range upsConfigs {
+		var monitor, ok = r.monitors[ups.name]
+		if !ok {
+			continue
+		}
+		if source, ok := sources[ups.name]; ok {
+			monitor.reconfigure(source, ups.minInterval)
+			log.Infof("ups %s: now reading %s every %s", ups.name, ups.kind, ups.minInterval)
+		}
+		monitor.setEnergyPrice(config.EnergyPricePerKWh)
+		if engine, ok := r.engines[ups.name]; ok {
+			engine.setPolicy(config.shutdownPolicy())
+		}
+	}
+
+	r.events.setLowBattery(config.Alerts.LowBattery)
+	r.notifier.setConfig(webhooks, webhookTemplate)
+
+	r.current = config
+	return nil
+}
+
+// warnRestart logs the changes that only take effect after a restart.
+func (r *reloader) warnRestart(config configFile, currentUPS, upsConfigs []upsConfig) {
+	var changed = map[string]bool{
+		"listen":                 r.current.Listen != config.Listen,
+		"state_file":             r.current.StateFile != config.StateFile,
+		"outputs.mqtt":           r.current.Outputs.MQTT != config.Outputs.MQTT,
+		"outputs.influx":         r.current.Outputs.Influx != config.Outputs.Influx,
+		"outputs.hooks":          r.current.Outputs.Hooks != config.Outputs.Hooks,
+		"ups (added or removed)": !sameUPSNames(currentUPS, upsConfigs),
+	}
+	for _, key := range sortedKeys(changed) {
+		if changed[key] {
+			log.Warnf("config %s changed, restart to apply it", key)
+		}
+	}
+}
+
+// sameUPSNames reports whether a and b configure the same UPSs.
+func sameUPSNames(a, b []upsConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var names = make(map[string]bool, len(a))
+	for _, ups := range a {
+		names[ups.name] = true
+	}
+	for _, ups := range b {
+		if !names[ups.name] {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP reloads the config, like Prometheus' /-/reload.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if err := r.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("config reloaded\n"))
+}
+
+// Describe implements prometheus.Collector.
+func (r *reloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- reloadSuccessfulDesc
+	ch <- reloadTimestampDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *reloader) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var successful float64
+	if r.successful {
+		successful = 1
+	}
+	ch <- prometheus.MustNewConstMetric(reloadSuccessfulDesc, prometheus.GaugeValue, successful)
+	ch <- prometheus.MustNewConstMetric(reloadTimestampDesc, prometheus.GaugeValue, unixSeconds(r.lastSuccess))
+}
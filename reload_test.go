@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader(t *testing.T) {
+	t.Parallel()
+
+	var path = writeConfigFile(t, "ups:\n  - name: rack1\n")
+	var base = testFlagConfig()
+	var conf, err = loadConfigFile(path, base)
+	assert.NoError(t, err)
+
+	var monitor = newUPSMonitor("rack1", fakePwrstatSource(testOutputNormal, nil), time.Minute)
+	monitor.restoreCounters(upsCounters{EnergyWattHours: 42})
+	var engines = map[string]*shutdownEngine{"rack1": newShutdownEngine("rack1", conf.shutdownPolicy())}
+	var events = newEventDetector(conf.Alerts.LowBattery)
+	webhooks, err := conf.webhookConfig()
+	assert.NoError(t, err)
+	notifier, err := newWebhookNotifier(webhooks)
+	assert.NoError(t, err)
+	var reloader = newReloader(path, base, conf, []*upsMonitor{monitor}, engines, events, notifier)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`
+energy_price_per_kwh: 0.2
+ups:
+  - name: rack1
+    source: nut
+    interval: 30s
+alerts:
+  low_battery: 35
+  shutdown:
+    battery_capacity: 10
+    dry_run: true
+outputs:
+  webhooks:
+    urls: [http://localhost/hook]
+    events: [on_battery]
+`), 0o600))
+
+	var rec = httptest.NewRecorder()
+	reloader.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the monitor is reconfigured in place, keeping its totals
+	assert.Equal(t, 30*time.Second, monitor.interval())
+	assert.IsType(t, &nutSource{}, monitor.source)
+	assert.Equal(t, 0.2, monitor.meter.pricePerKWh)
+	assert.Equal(t, float64(42), monitor.snapshotCounters().EnergyWattHours)
+	assert.Equal(t, 35, events.lowBattery)
+	assert.Equal(t, 10, engines["rack1"].policy.batteryCapacity)
+	assert.Equal(t, []string{"http://localhost/hook"}, notifier.config.urls)
+	assert.True(t, notifier.events[eventOnBattery])
+	assert.False(t, notifier.events[eventLowBattery])
+
+	// a bad config is not applied at all
+	assert.NoError(t, os.WriteFile(path, []byte("alerts:\n  low_battery: 50\nups:\n  - name: rack1\n    source: usb\n"), 0o600))
+	rec = httptest.NewRecorder()
+	reloader.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "ups[0].source: unknown source: usb")
+	assert.Equal(t, 35, events.lowBattery)
+
+	assert.NoError(t, testutil.CollectAndCompare(reloader, strings.NewReader(`
+# HELP cyber_power_exporter_config_last_reload_successful 1 if the last reload of the -config file succeeded, 0 otherwise
+# TYPE cyber_power_exporter_config_last_reload_successful gauge
+cyber_power_exporter_config_last_reload_successful 0
+`), "cyber_power_exporter_config_last_reload_successful"))
+}
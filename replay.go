@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoCaptures         = errors.New("no captures found")
+	errInvalidReplaySpeed = errors.New("invalid replay speed")
+)
+
+// capture is the raw output of one pwrstat run.
+type capture struct {
+	name string
+	at   time.Time
+	out  string
+}
+
+// replaySource reads pwrstat output captured with -record-dir, from a
+// directory or a tarball of one, and parses it as if pwrstat had just printed
+// it. Captures are played at speed times the pace they were taken at, or one
+// per read if speed is 0. The last capture is repeated once they run out.
+type replaySource struct {
+	captures []capture
+	speed    float64
+	now      func() time.Time
+
+	mu    sync.Mutex
+	start time.Time
+	next  int
+}
+
+// newReplaySource loads the captures at path.
+func newReplaySource(path string, speed float64) (*replaySource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: no -replay path", errNoCaptures)
+	}
+	if speed < 0 {
+		return nil, fmt.Errorf("%w: %g, must not be negative", errInvalidReplaySpeed, speed)
+	}
+
+	var captures, err = loadCaptures(path)
+	if err != nil {
+		return nil, err
+	}
+	return &replaySource{captures: captures, speed: speed, now: time.Now}, nil
+}
+
+func (s *replaySource) Fetch(context.Context) (Device, DeviceStatus, error) {
+	s.mu.Lock()
+	var c = s.current()
+	s.mu.Unlock()
+
+	return parsePwrstatOutput(c.out)
+}
+
+// current returns the capture to play now. The caller must hold s.mu.
+func (s *replaySource) current() capture {
+	if s.speed == 0 {
+		var i = min(s.next, len(s.captures)-1)
+		s.next++
+		return s.captures[i]
+	}
+
+	var now = s.now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	var played = s.captures[0].at.Add(time.Duration(float64(now.Sub(s.start)) * s.speed))
+	// the last capture taken by then
+	var i = sort.Search(len(s.captures), func(i int) bool { return s.captures[i].at.After(played) }) - 1
+	return s.captures[i]
+}
+
+// loadCaptures reads the captures in a directory or a tar, optionally
+// gzipped, file, in the order they were taken. Files not named like a
+// capture are played a second after the one before them.
+func loadCaptures(path string) ([]capture, error) {
+	var info, err = os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read captures: %s, err: %w", path, err)
+	}
+
+	var captures []capture
+	if info.IsDir() {
+		captures, err = loadCaptureDir(path)
+	} else {
+		captures, err = loadCaptureTar(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(captures) == 0 {
+		return nil, fmt.Errorf("%w in %s", errNoCaptures, path)
+	}
+
+	slices.SortFunc(captures, func(a, b capture) int { return strings.Compare(a.name, b.name) })
+	for i := range captures {
+		if at, ok := captureTime(captures[i].name); ok {
+			captures[i].at = at
+		} else if i > 0 {
+			captures[i].at = captures[i-1].at.Add(time.Second)
+		}
+	}
+	// names that do not sort in time order would play out of order
+	slices.SortStableFunc(captures, func(a, b capture) int { return a.at.Compare(b.at) })
+	return captures, nil
+}
+
+func loadCaptureDir(dir string) ([]capture, error) {
+	var entries, err = os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read captures: %s, err: %w", dir, err)
+	}
+
+	var captures []capture
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || hiddenFile(entry.Name()) {
+			continue
+		}
+		var out, err = os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read capture: %s, err: %w", entry.Name(), err)
+		}
+		captures = append(captures, capture{name: entry.Name(), out: string(out)})
+	}
+	return captures, nil
+}
+
+func loadCaptureTar(path string) ([]capture, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read captures: %s, err: %w", path, err)
+	}
+	defer file.Close()
+
+	var buffered = bufio.NewReader(file)
+	var r io.Reader = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		var gz, err = gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read captures: %s, err: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var captures []capture
+	var archive = tar.NewReader(r)
+	for {
+		var header, err = archive.Next()
+		if errors.Is(err, io.EOF) {
+			return captures, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read captures: %s, err: %w", path, err)
+		}
+		if header.Typeflag != tar.TypeReg || hiddenFile(header.Name) {
+			continue
+		}
+		out, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read capture: %s, err: %w", header.Name, err)
+		}
+		captures = append(captures, capture{name: header.Name, out: string(out)})
+	}
+}
+
+// hiddenFile reports whether name is a dot file, e.g. one macOS adds to a tar,
+// rather than a capture.
+func hiddenFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".")
+}
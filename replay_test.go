@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordCaptures records outputs ten seconds apart and returns the directory.
+func recordCaptures(t *testing.T, outputs ...string) string {
+	t.Helper()
+
+	var dir = t.TempDir()
+	var recorder = newCaptureRecorder(dir, 0)
+	var start = time.Date(2026, time.October, 17, 18, 15, 19, 0, time.UTC)
+	for i, out := range outputs {
+		assert.NoError(t, recorder.record(start.Add(time.Duration(i)*10*time.Second), out))
+	}
+	return dir
+}
+
+func TestReplaySourceByRead(t *testing.T) {
+	t.Parallel()
+
+	var source, err = newReplaySource(recordCaptures(t, testOutputNormal, testOutputBlackout, "garbage"), 0)
+	assert.NoError(t, err)
+
+	_, status, err := source.Fetch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Normal", status.State)
+
+	device, status, err := source.Fetch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Power Failure", status.State)
+	assert.Equal(t, "CP1500PFCLCDa", device.ModelName)
+
+	// a capture that does not parse fails like it did live, and keeps failing
+	// once the captures run out
+	for range 2 {
+		_, _, err = source.Fetch(context.Background())
+		var sErr *scrapeError
+		assert.True(t, errors.As(err, &sErr))
+		assert.Equal(t, stageParseStatus, sErr.stage)
+		assert.Equal(t, "getState", sErr.getter)
+	}
+}
+
+func TestReplaySourceBySpeed(t *testing.T) {
+	t.Parallel()
+
+	var source, err = newReplaySource(recordCaptures(t, testOutputNormal, testOutputBlackout, testLostConnection), 10)
+	assert.NoError(t, err)
+	var now = time.Now()
+
+	// captures ten seconds apart are a second apart at ten times the speed
+	for _, step := range []struct {
+		after time.Duration
+		state string
+	}{
+		{0, "Normal"},
+		{999 * time.Millisecond, "Normal"},
+		{time.Second, "Power Failure"},
+		{1500 * time.Millisecond, "Power Failure"},
+		{2 * time.Second, "Lost Communication"},
+		{time.Hour, "Lost Communication"},
+	} {
+		source.now = func() time.Time { return now.Add(step.after) }
+		var _, status, err = source.Fetch(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, step.state, status.State, step.after)
+	}
+}
+
+func TestReplaySourceTarball(t *testing.T) {
+	t.Parallel()
+
+	var dir = recordCaptures(t, testOutputNormal, testOutputBlackout)
+	names, err := captureNames(dir)
+	assert.NoError(t, err)
+
+	// a tar.gz of the rack1 directory as attached to a bug report, with the
+	// files out of order and a macOS resource fork
+	var tarball = filepath.Join(t.TempDir(), "captures.tar.gz")
+	file, err := os.Create(tarball)
+	assert.NoError(t, err)
+	var gz = gzip.NewWriter(file)
+	var archive = tar.NewWriter(gz)
+	assert.NoError(t, archive.WriteHeader(&tar.Header{Name: "rack1/", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for _, name := range []string{names[1], "._" + names[0], names[0]} {
+		var out, _ = os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: "rack1/" + name, Typeflag: tar.TypeReg, Mode: 0o600, Size: int64(len(out))}))
+		_, err = archive.Write(out)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, file.Close())
+
+	source, err := newReplaySource(tarball, 0)
+	assert.NoError(t, err)
+	assert.Len(t, source.captures, 2)
+
+	_, status, err := source.Fetch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Normal", status.State)
+	_, status, err = source.Fetch(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Power Failure", status.State)
+}
+
+func TestReplaySourceErrors(t *testing.T) {
+	t.Parallel()
+
+	var _, err = newReplaySource("", 1)
+	assert.ErrorIs(t, err, errNoCaptures)
+
+	_, err = newReplaySource(t.TempDir(), 1)
+	assert.ErrorIs(t, err, errNoCaptures)
+
+	_, err = newReplaySource(filepath.Join(t.TempDir(), "missing"), 1)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = newReplaySource(recordCaptures(t, testOutputNormal), -1)
+	assert.ErrorIs(t, err, errInvalidReplaySpeed)
+
+	var notTar = filepath.Join(t.TempDir(), "capture.txt")
+	assert.NoError(t, os.WriteFile(notTar, []byte(testOutputNormal), 0o600))
+	_, err = newReplaySource(notTar, 1)
+	assert.Error(t, err)
+}
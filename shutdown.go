@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errShutdownNoAction = errors.New("a shutdown threshold is set but there is no -shutdown-exec or -shutdown-url to run")
+	errShutdownHTTP     = errors.New("shutdown endpoint returned an error")
+)
+
+// shutdownActionTimeout bounds each shutdown command and HTTP call.
+const shutdownActionTimeout = 30 * time.Second
+
+// shutdownPolicy decides when a UPS running on battery should take its loads
+// down and what to run when it does. A zero threshold is disabled.
+type shutdownPolicy struct {
+	batteryCapacity  int           // shut down at or below this battery capacity %
+	remainingRuntime time.Duration // shut down at or below this remaining runtime
+	onBattery        time.Duration // shut down after this long on battery
+	grace            time.Duration // countdown before acting, cancelled if utility power returns
+	commands         []string      // run locally with sh -c
+	urls             []string      // POSTed a JSON description of the shutdown
+	dryRun           bool          // log the actions instead of running them
+}
+
+// enabled reports whether any threshold is set.
+func (p shutdownPolicy) enabled() bool {
+	return p.batteryCapacity > 0 || p.remainingRuntime > 0 || p.onBattery > 0
+}
+
+func (p shutdownPolicy) validate() error {
+	if p.enabled() && !p.dryRun && len(p.commands) == 0 && len(p.urls) == 0 {
+		return errShutdownNoAction
+	}
+	return nil
+}
+
+// reason returns why status calls for a shutdown, or "" if it does not.
+func (p shutdownPolicy) reason(status DeviceStatus, onBatteryFor time.Duration) string {
+	switch {
+	case p.batteryCapacity > 0 && status.BatteryCapacity <= p.batteryCapacity:
+		return fmt.Sprintf("battery capacity %d%% is at or below %d%%", status.BatteryCapacity, p.batteryCapacity)
+	case p.remainingRuntime > 0 && status.RemainingRuntime <= p.remainingRuntime:
+		return fmt.Sprintf("remaining runtime %s is at or below %s", status.RemainingRuntime, p.remainingRuntime)
+	case p.onBattery > 0 && onBatteryFor >= p.onBattery:
+		return fmt.Sprintf("on battery for %s", onBatteryFor.Truncate(time.Second))
+	default:
+		return ""
+	}
+}
+
+// shutdownEngine applies a shutdownPolicy to the readings of one UPS. Once a
+// threshold is crossed on battery it counts down the grace period and then
+// runs the actions, unless utility power returns first.
+type shutdownEngine struct {
+	ups    string
+	client *http.Client
+	now    func() time.Time
+	run    func(ctx context.Context, command string, env []string) error
+
+	mu             sync.Mutex
+	policy         shutdownPolicy
+	onBatterySince time.Time
+	deadline       time.Time
+	reason         string
+	fired          bool
+	wg             sync.WaitGroup
+}
+
+func newShutdownEngine(ups string, policy shutdownPolicy) *shutdownEngine {
+	return &shutdownEngine{
+		ups:    ups,
+		policy: policy,
+		client: &http.Client{},
+		now:    time.Now,
+		run:    runShutdownCommand,
+	}
+}
+
+// setPolicy replaces the policy, a countdown in progress is cancelled if the
+// new policy is disabled and otherwise runs out as before.
+func (e *shutdownEngine) setPolicy(policy shutdownPolicy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.policy = policy
+	if !policy.enabled() {
+		if !e.deadline.IsZero() && !e.fired {
+			log.Infof("ups %s: shutdown policy disabled, shutdown cancelled", e.ups)
+		}
+		e.onBatterySince, e.deadline, e.reason, e.fired = time.Time{}, time.Time{}, "", false
+	}
+}
+
+// observe is a upsMonitor observer.
+func (e *shutdownEngine) observe(reading upsReading) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.policy.enabled() {
+		return
+	}
+	var now = e.now()
+
+	// failed reads neither start nor cancel a countdown, but one in progress
+	// still runs out, the UPS may be dying
+	if reading.err == nil && reading.status.State != "Lost Communication" {
+		if reading.status.PowerSupplyBy != "Battery Power" {
+			if !e.deadline.IsZero() {
+				log.Infof("ups %s: utility power is back, shutdown cancelled", e.ups)
+			}
+			e.onBatterySince, e.deadline, e.reason, e.fired = time.Time{}, time.Time{}, "", false
+			return
+		}
+
+		if e.onBatterySince.IsZero() {
+			e.onBatterySince = now
+		}
+		if e.deadline.IsZero() {
+			if reason := e.policy.reason(reading.status, now.Sub(e.onBatterySince)); reason != "" {
+				e.deadline, e.reason = now.Add(e.policy.grace), reason
+				log.Warnf("ups %s: %s, shutting down in %s unless utility power returns", e.ups, reason, e.policy.grace)
+			}
+		}
+	}
+
+	if e.deadline.IsZero() || e.fired || now.Before(e.deadline) {
+		return
+	}
+	e.fired = true
+
+	// actions can take a while, readers of the monitor must not wait for them
+	var policy, reason = e.policy, e.reason
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.shutdown(policy, reason, reading.status)
+	}()
+}
+
+// wait blocks until running actions are done.
+func (e *shutdownEngine) wait() {
+	e.wg.Wait()
+}
+
+// shutdown runs every action, a failing action does not stop the others.
+func (e *shutdownEngine) shutdown(policy shutdownPolicy, reason string, status DeviceStatus) {
+	log.Warnf("ups %s: shutting down, %s", e.ups, reason)
+
+	var env = []string{
+		"CYBERPOWER_UPS=" + e.ups,
+		"CYBERPOWER_REASON=" + reason,
+		"CYBERPOWER_BATTERY_CAPACITY=" + strconv.Itoa(status.BatteryCapacity),
+		"CYBERPOWER_REMAINING_RUNTIME=" + strconv.Itoa(int(status.RemainingRuntime.Seconds())),
+	}
+	for _, command := range policy.commands {
+		if policy.dryRun {
+			log.Infof("ups %s: dry run, would run %q", e.ups, command)
+			continue
+		}
+		var ctx, cancel = context.WithTimeout(context.Background(), shutdownActionTimeout)
+		if err := e.run(ctx, command, env); err != nil {
+			log.Errorf("ups %s: shutdown command %q failed: %s", e.ups, command, err)
+		}
+		cancel()
+	}
+
+	var body, err = json.Marshal(map[string]any{
+		"ups":                       e.ups,
+		"reason":                    reason,
+		"battery_capacity":          status.BatteryCapacity,
+		"remaining_runtime_seconds": status.RemainingRuntime.Seconds(),
+	})
+	if err != nil {
+		log.Errorf("ups %s: unable to encode shutdown request, err: %s", e.ups, err)
+		return
+	}
+	for _, url := range policy.urls {
+		if policy.dryRun {
+			log.Infof("ups %s: dry run, would POST %s", e.ups, url)
+			continue
+		}
+		var ctx, cancel = context.WithTimeout(context.Background(), shutdownActionTimeout)
+		if err := e.post(ctx, url, body); err != nil {
+			log.Errorf("ups %s: %s", e.ups, err)
+		}
+		cancel()
+	}
+}
+
+func (e *shutdownEngine) post(ctx context.Context, url string, body []byte) error {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to build shutdown request for %s, err: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to call shutdown endpoint %s, err: %w", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s returned %s", errShutdownHTTP, url, resp.Status)
+	}
+	return nil
+}
+
+// runShutdownCommand runs command with sh so it can be a full command line.
+func runShutdownCommand(ctx context.Context, command string, env []string) error {
+	var cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = time.Second
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to run shutdown command, output: %s, err: %w", bytes.TrimSpace(out), err)
+	}
+	return nil
+}
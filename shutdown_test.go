@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShutdownEngine returns an engine with a settable clock that records the
+// commands it runs instead of running them.
+func fakeShutdownEngine(policy shutdownPolicy) (*shutdownEngine, *time.Time, func() []string) {
+	var engine = newShutdownEngine("cyberpower", policy)
+
+	var now = time.Date(2023, 3, 9, 12, 0, 0, 0, time.UTC)
+	engine.now = func() time.Time { return now }
+
+	var mu sync.Mutex
+	var ran []string
+	engine.run = func(_ context.Context, command string, env []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, command+" "+strings.Join(env, " "))
+		return nil
+	}
+
+	return engine, &now, func() []string {
+		engine.wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return ran
+	}
+}
+
+func TestShutdownPolicy(t *testing.T) {
+	t.Parallel()
+
+	var status = DeviceStatus{BatteryCapacity: 40, RemainingRuntime: 20 * time.Minute}
+
+	assert.False(t, shutdownPolicy{}.enabled())
+	assert.NoError(t, shutdownPolicy{}.validate())
+	assert.ErrorIs(t, shutdownPolicy{batteryCapacity: 20}.validate(), errShutdownNoAction)
+	assert.NoError(t, shutdownPolicy{batteryCapacity: 20, dryRun: true}.validate())
+
+	assert.Empty(t, shutdownPolicy{batteryCapacity: 20, remainingRuntime: 10 * time.Minute}.reason(status, time.Hour))
+	assert.Equal(t, "battery capacity 40% is at or below 50%", shutdownPolicy{batteryCapacity: 50}.reason(status, 0))
+	assert.Equal(t, "remaining runtime 20m0s is at or below 30m0s", shutdownPolicy{remainingRuntime: 30 * time.Minute}.reason(status, 0))
+	assert.Equal(t, "on battery for 5m0s", shutdownPolicy{onBattery: 5 * time.Minute}.reason(status, 5*time.Minute))
+}
+
+func TestShutdownEngineCountdown(t *testing.T) {
+	t.Parallel()
+
+	var engine, now, ran = fakeShutdownEngine(shutdownPolicy{
+		batteryCapacity: 40,
+		grace:           time.Minute,
+		commands:        []string{"poweroff"},
+	})
+	var monitor = newUPSMonitor("cyberpower", fakePwrstatSource(testOutputBlackout, nil), 0)
+	monitor.observe(engine.observe)
+
+	// 39% on battery starts the countdown
+	monitor.update()
+	assert.Empty(t, ran())
+
+	*now = now.Add(30 * time.Second)
+	monitor.update()
+	assert.Empty(t, ran())
+
+	// it runs out, the actions run once
+	*now = now.Add(30 * time.Second)
+	monitor.update()
+	*now = now.Add(30 * time.Second)
+	monitor.update()
+	assert.Equal(t, []string{
+		"poweroff CYBERPOWER_UPS=cyberpower CYBERPOWER_REASON=battery capacity 39% is at or below 40% " +
+			"CYBERPOWER_BATTERY_CAPACITY=39 CYBERPOWER_REMAINING_RUNTIME=1440",
+	}, ran())
+}
+
+func TestShutdownEngineCancel(t *testing.T) {
+	t.Parallel()
+
+	var engine, now, ran = fakeShutdownEngine(shutdownPolicy{
+		onBattery: time.Minute,
+		grace:     time.Minute,
+		commands:  []string{"poweroff"},
+	})
+	var source = fakePwrstatSource(testOutputBlackout, nil)
+	var monitor = newUPSMonitor("cyberpower", source, 0)
+	monitor.observe(engine.observe)
+
+	monitor.update()
+	*now = now.Add(time.Minute)
+	monitor.update() // on battery for a minute, countdown started
+
+	// utility power returns before the grace period is over
+	source.getStats = func(context.Context, string) (string, error) { return testOutputNormal, nil }
+	*now = now.Add(30 * time.Second)
+	monitor.update()
+
+	source.getStats = func(context.Context, string) (string, error) { return testOutputBlackout, nil }
+	*now = now.Add(time.Minute)
+	monitor.update()
+	*now = now.Add(time.Minute)
+	monitor.update()
+	assert.Empty(t, ran())
+}
+
+func TestShutdownEngineHTTPAndDryRun(t *testing.T) {
+	t.Parallel()
+
+	var requests = make(chan map[string]any, 1)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+
+	var status, err = parsePowerStatus(testOutputBlackout)
+	assert.NoError(t, err)
+
+	var engine, _, ran = fakeShutdownEngine(shutdownPolicy{
+		remainingRuntime: 30 * time.Minute,
+		commands:         []string{"poweroff"},
+		urls:             []string{server.URL},
+	})
+	engine.observe(upsReading{ups: "cyberpower", status: status})
+	assert.Equal(t, []string{
+		"poweroff CYBERPOWER_UPS=cyberpower CYBERPOWER_REASON=remaining runtime 24m0s is at or below 30m0s " +
+			"CYBERPOWER_BATTERY_CAPACITY=39 CYBERPOWER_REMAINING_RUNTIME=1440",
+	}, ran())
+	assert.Equal(t, map[string]any{
+		"ups":                       "cyberpower",
+		"reason":                    "remaining runtime 24m0s is at or below 30m0s",
+		"battery_capacity":          float64(39),
+		"remaining_runtime_seconds": float64(1440),
+	}, <-requests)
+
+	// dry run does neither
+	engine, _, ran = fakeShutdownEngine(shutdownPolicy{
+		remainingRuntime: 30 * time.Minute,
+		commands:         []string{"poweroff"},
+		urls:             []string{server.URL},
+		dryRun:           true,
+	})
+	engine.observe(upsReading{ups: "cyberpower", status: status})
+	assert.Empty(t, ran())
+	assert.Empty(t, requests)
+}
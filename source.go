@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errUnknownSource = errors.New("unknown source")
+
+// scrape stages used as the stage label of the scrape error counter.
+const (
+	stageExec        = "exec"
+	stageExecTimeout = "exec_timeout" // the command ran past its timeout and was killed
+	stageExecBusy    = "exec_busy"    // the last command has not exited yet
+	stageParseStatus = "parse_status"
+	stageParseDevice = "parse_device"
+)
+
+// Source is a backend that reads the current state of a UPS. Errors should be
+// a *scrapeError so the collector can count them by stage.
+type Source interface {
+	Fetch(ctx context.Context) (Device, DeviceStatus, error)
+}
+
+// sourceConfig holds the options for every backend, only the fields for the
+// selected backend are used.
+type sourceConfig struct {
+	cmdPath     string
+	execTimeout time.Duration
+	recordDir   string // save pwrstat output here, see captureRecorder
+	recordKeep  int
+	hidDevice   string
+	nutAddr     string
+	nutUPS      string
+	replayPath  string
+	replaySpeed float64
+}
+
+// newSource returns the backend named by kind.
+func newSource(kind string, config sourceConfig) (Source, error) {
+	switch kind {
+	case "pwrstat":
+		var source = newPwrstatSource(config.cmdPath, config.execTimeout)
+		if config.recordDir != "" {
+			source.recorder = newCaptureRecorder(config.recordDir, config.recordKeep)
+		}
+		return source, nil
+	case "hid":
+		return newHIDSource(config.hidDevice), nil
+	case "nut":
+		return newNUTSource(config.nutAddr, config.nutUPS), nil
+	case "replay":
+		var source, err = newReplaySource(config.replayPath, config.replaySpeed)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownSource, kind)
+	}
+}
+
+// scrapeError tags a fetch failure with the stage and getter that failed so
+// it can be counted.
+type scrapeError struct {
+	stage  string
+	getter string
+	err    error
+}
+
+func (e *scrapeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+// failedGetter returns the name of the getter that produced err, if known.
+func failedGetter(err error) string {
+	var gErr *getterError
+	if errors.As(err, &gErr) {
+		return gErr.getter
+	}
+	return "unknown"
+}
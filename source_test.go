@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSource(t *testing.T) {
+	t.Parallel()
+
+	var source, err = newSource("pwrstat", sourceConfig{cmdPath: "/usr/sbin/pwrstat"})
+	assert.NoError(t, err)
+	assert.IsType(t, &pwrstatSource{}, source)
+
+	source, err = newSource("hid", sourceConfig{hidDevice: "/dev/hidraw0"})
+	assert.NoError(t, err)
+	assert.IsType(t, &hidSource{}, source)
+
+	source, err = newSource("nut", sourceConfig{nutAddr: "localhost:3493"})
+	assert.NoError(t, err)
+	assert.IsType(t, &nutSource{}, source)
+
+	source, err = newSource("replay", sourceConfig{replayPath: recordCaptures(t, testOutputNormal)})
+	assert.NoError(t, err)
+	assert.IsType(t, &replaySource{}, source)
+
+	source, err = newSource("replay", sourceConfig{})
+	assert.ErrorIs(t, err, errNoCaptures)
+	assert.Nil(t, source)
+
+	source, err = newSource("pwrstat", sourceConfig{cmdPath: "/usr/sbin/pwrstat", recordDir: "/tmp/rack1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/rack1", source.(*pwrstatSource).recorder.dir)
+
+	source, err = newSource("snmp", sourceConfig{})
+	assert.ErrorIs(t, err, errUnknownSource)
+	assert.Nil(t, source)
+}
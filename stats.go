@@ -1,77 +1,391 @@
 package main
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// stateUnknown is the state set member for values we do not recognize.
+const stateUnknown = "unknown"
+
+// The known values of each state set metric, every one is always exported so
+// queries never have to deal with series appearing and disappearing.
+// nolint: gochecknoglobals
+var (
+	upsStates        = []string{"Normal", "Power Failure", "Lost Communication"}
+	powerSupplyKinds = []string{"Utility Power", "Battery Power"}
+	testResults      = []string{"Passed", "Warning", "Error", "Failed", "Aborted", "In progress", "None"}
 )
 
 // nolint: gochecknoglobals
 var (
 	promNamespace = "cyber_power_exporter"
 
-	stateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "state",
-		Help:      "0=Normal / 1=Power Failure",
-	}, []string{"model_name"})
-
-	powerSuppliedByGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "power_supplied_by",
-		Help:      "0=Utility Power / 1=Battery Power",
-	}, []string{"model_name"})
-
-	utilityVoltageGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "utility_voltage",
-		Help:      "Utility Voltage",
-	}, []string{"model_name"})
-
-	outputVoltageGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "output_voltage",
-		Help:      "Output Voltage",
-	}, []string{"model_name"})
-
-	batteryCapacityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "battery_capacity",
-		Help:      "Battery Capacity as %",
-	}, []string{"model_name"})
-
-	remainingRuntimeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "remaining_runtime",
-		Help:      "Remaining Runtime on battery in seconds",
-	}, []string{"model_name"})
-
-	loadWattsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "load_watts",
-		Help:      "Current Load in watts",
-	}, []string{"model_name"})
-
-	loadPctGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "load_pct",
-		Help:      "current load as %",
-	}, []string{"model_name"})
-
-	lineInteractionGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "line_interaction",
-		Help:      "ups line interaction",
-	}, []string{"model_name"})
-
-	testResultGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "test_result",
-		Help:      "result of last test result",
-	}, []string{"model_name"})
-
-	lastPowerEventDurationGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: promNamespace,
-		Name:      "last_power_event_duration",
-		Help:      "how long the last event lasted",
-	}, []string{"model_name"})
+	stateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "state"),
+		"0=Normal / 1=Power Failure",
+		[]string{"ups"}, nil,
+	)
+
+	powerSuppliedByDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "power_supplied_by"),
+		"0=Utility Power / 1=Battery Power",
+		[]string{"ups"}, nil,
+	)
+
+	utilityVoltageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "utility_voltage"),
+		"Utility Voltage",
+		[]string{"ups"}, nil,
+	)
+
+	outputVoltageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "output_voltage"),
+		"Output Voltage",
+		[]string{"ups"}, nil,
+	)
+
+	batteryCapacityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "battery_capacity"),
+		"Battery Capacity as %",
+		[]string{"ups"}, nil,
+	)
+
+	remainingRuntimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "remaining_runtime"),
+		"Remaining Runtime on battery in seconds",
+		[]string{"ups"}, nil,
+	)
+
+	loadWattsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "load_watts"),
+		"Current Load in watts",
+		[]string{"ups"}, nil,
+	)
+
+	loadPctDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "load_pct"),
+		"current load as %",
+		[]string{"ups"}, nil,
+	)
+
+	lineInteractionDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "line_interaction"),
+		"ups line interaction",
+		[]string{"ups"}, nil,
+	)
+
+	testResultDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "test_result"),
+		"result of last test result",
+		[]string{"ups"}, nil,
+	)
+
+	lastPowerEventDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "last_power_event_duration"),
+		"how long the last event lasted",
+		[]string{"ups"}, nil,
+	)
+
+	lastSelfTestTimestampDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "last_self_test_timestamp_seconds"),
+		"unix time of the last self test",
+		[]string{"ups"}, nil,
+	)
+
+	lastPowerEventTimestampDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "last_power_event_timestamp_seconds"),
+		"unix time the last power event started",
+		[]string{"ups"}, nil,
+	)
+
+	lastPowerEventInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "last_power_event_info"),
+		"type of the last power event, always 1",
+		[]string{"ups", "type"}, nil,
+	)
+
+	upsStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "ups_state"),
+		"1 for the current UPS state, 0 for the others",
+		[]string{"ups", "state"}, nil,
+	)
+
+	powerSupplyStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "power_supply_state"),
+		"1 for what the UPS output is currently supplied by, 0 for the others",
+		[]string{"ups", "supply"}, nil,
+	)
+
+	testResultStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "test_result_state"),
+		"1 for the result of the last self test, 0 for the others",
+		[]string{"ups", "result"}, nil,
+	)
+
+	communicationLostDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "communication_lost"),
+		"1 if the UPS software lost communication with the UPS, 0 otherwise",
+		[]string{"ups"}, nil,
+	)
+
+	upDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "up"),
+		"1 if the last UPS read and parse succeeded, 0 otherwise",
+		[]string{"ups"}, nil,
+	)
+
+	lastScrapeSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "last_scrape_success_timestamp_seconds"),
+		"unix time of the last successful UPS read and parse",
+		[]string{"ups"}, nil,
+	)
+
+	scrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "scrape_duration_seconds"),
+		"how long the last UPS read and parse took",
+		[]string{"ups"}, nil,
+	)
+
+	scrapeErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "scrape_errors_total"),
+		"UPS read failures by stage and the getter that failed",
+		[]string{"ups", "stage", "getter"}, nil,
+	)
+
+	energyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "energy_watt_hours_total"),
+		"energy delivered to the load, integrated from load watts",
+		[]string{"ups"}, nil,
+	)
+
+	energyCostDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "energy_cost_total"),
+		"cost of the energy delivered to the load at -energy-price-per-kwh",
+		[]string{"ups"}, nil,
+	)
+
+	powerEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "power_events_total"),
+		"power events by type",
+		[]string{"ups", "type"}, nil,
+	)
+
+	onBatteryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "on_battery_seconds_total"),
+		"time spent running on battery",
+		[]string{"ups"}, nil,
+	)
+
+	deviceInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "device_info"),
+		"UPS model and firmware, always 1",
+		[]string{"ups", "model_name", "firmware"}, nil,
+	)
+
+	ratingVoltageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "rating_voltage_volts"),
+		"rated output voltage of the UPS",
+		[]string{"ups"}, nil,
+	)
+
+	ratingPowerWattsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "rating_power_watts"),
+		"rated real power of the UPS in watts",
+		[]string{"ups"}, nil,
+	)
+
+	ratingPowerVADesc = prometheus.NewDesc(
+		prometheus.BuildFQName(promNamespace, "", "rating_power_va"),
+		"rated apparent power of the UPS in volt-amperes",
+		[]string{"ups"}, nil,
+	)
 )
+
+// UPSCollector is a prometheus.Collector that reads every UPS at scrape time.
+// Each UPS is read concurrently through its own upsMonitor. If the last read
+// of a UPS failed, no metrics but the scrape health ones are emitted for it
+// rather than serving stale values.
+type UPSCollector struct {
+	monitors []*upsMonitor
+}
+
+// NewUPSCollector returns a collector for the given UPS monitors.
+func NewUPSCollector(monitors ...*upsMonitor) *UPSCollector {
+	return &UPSCollector{monitors: monitors}
+}
+
+// Describe implements prometheus.Collector.
+func (c *UPSCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stateDesc
+	ch <- powerSuppliedByDesc
+	ch <- utilityVoltageDesc
+	ch <- outputVoltageDesc
+	ch <- batteryCapacityDesc
+	ch <- remainingRuntimeDesc
+	ch <- loadWattsDesc
+	ch <- loadPctDesc
+	ch <- lineInteractionDesc
+	ch <- testResultDesc
+	ch <- lastPowerEventDurationDesc
+	ch <- lastSelfTestTimestampDesc
+	ch <- lastPowerEventTimestampDesc
+	ch <- lastPowerEventInfoDesc
+	ch <- upsStateDesc
+	ch <- powerSupplyStateDesc
+	ch <- testResultStateDesc
+	ch <- communicationLostDesc
+	ch <- upDesc
+	ch <- lastScrapeSuccessDesc
+	ch <- scrapeDurationDesc
+	ch <- scrapeErrorsDesc
+	ch <- energyDesc
+	ch <- energyCostDesc
+	ch <- powerEventsDesc
+	ch <- onBatteryDesc
+	ch <- deviceInfoDesc
+	ch <- ratingVoltageDesc
+	ch <- ratingPowerWattsDesc
+	ch <- ratingPowerVADesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *UPSCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, monitor := range c.monitors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collectUPS(ch, monitor.name, monitor.snapshot())
+		}()
+	}
+	wg.Wait()
+}
+
+// collectUPS emits the metrics of a single UPS.
+func collectUPS(ch chan<- prometheus.Metric, name string, snap upsSnapshot) {
+	var up float64
+	if snap.err == nil {
+		up = 1
+	}
+	var lastSuccess float64
+	if !snap.lastSuccess.IsZero() {
+		lastSuccess = unixSeconds(snap.lastSuccess)
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up, name)
+	ch <- prometheus.MustNewConstMetric(lastScrapeSuccessDesc, prometheus.GaugeValue, lastSuccess, name)
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, snap.scrapeDuration.Seconds(), name)
+	for key, count := range snap.scrapeErrors {
+		ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.CounterValue, count, name, key.stage, key.getter)
+	}
+	ch <- prometheus.MustNewConstMetric(energyDesc, prometheus.CounterValue, snap.counters.EnergyWattHours, name)
+	if snap.energyPriced {
+		ch <- prometheus.MustNewConstMetric(energyCostDesc, prometheus.CounterValue, snap.counters.EnergyCost, name)
+	}
+	ch <- prometheus.MustNewConstMetric(onBatteryDesc, prometheus.CounterValue, snap.counters.OnBatterySeconds, name)
+	for eventType, count := range snap.counters.PowerEvents {
+		ch <- prometheus.MustNewConstMetric(powerEventsDesc, prometheus.CounterValue, count, name, eventType)
+	}
+
+	if snap.err != nil {
+		return
+	}
+
+	var device, status = snap.device, snap.status
+
+	ch <- prometheus.MustNewConstMetric(deviceInfoDesc, prometheus.GaugeValue, 1, name, device.ModelName, device.FirmwareNumber)
+	// not every source knows the ratings, a missing one is left out
+	// rather than reported as 0
+	if device.RatingVoltage != 0 {
+		ch <- prometheus.MustNewConstMetric(ratingVoltageDesc, prometheus.GaugeValue, float64(device.RatingVoltage), name)
+	}
+	if device.RatingPowerWatts != 0 {
+		ch <- prometheus.MustNewConstMetric(ratingPowerWattsDesc, prometheus.GaugeValue, float64(device.RatingPowerWatts), name)
+	}
+	if device.RatingPowerVA != 0 {
+		ch <- prometheus.MustNewConstMetric(ratingPowerVADesc, prometheus.GaugeValue, float64(device.RatingPowerVA), name)
+	}
+
+	collectStateSet(ch, upsStateDesc, name, status.State, upsStates)
+
+	if status.LastPowerEvent != "" {
+		ch <- prometheus.MustNewConstMetric(lastPowerEventInfoDesc, prometheus.GaugeValue, 1, name, status.LastPowerEvent)
+	}
+	if !status.LastPowerEventTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastPowerEventTimestampDesc, prometheus.GaugeValue, unixSeconds(status.LastPowerEventTime), name)
+	}
+	if !status.TestResultTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastSelfTestTimestampDesc, prometheus.GaugeValue, unixSeconds(status.TestResultTime), name)
+	}
+
+	// pwrstat reports nothing but the state and last events when it cannot talk
+	// to the UPS, zero readings would be misleading
+	if status.State == "Lost Communication" {
+		ch <- prometheus.MustNewConstMetric(communicationLostDesc, prometheus.GaugeValue, 1, name)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(communicationLostDesc, prometheus.GaugeValue, 0, name)
+
+	collectStateSet(ch, powerSupplyStateDesc, name, status.PowerSupplyBy, powerSupplyKinds)
+	collectStateSet(ch, testResultStateDesc, name, status.TestResult, testResults)
+
+	switch status.State {
+	case "Normal":
+		ch <- prometheus.MustNewConstMetric(stateDesc, prometheus.GaugeValue, 0, name)
+	case "Power Failure":
+		ch <- prometheus.MustNewConstMetric(stateDesc, prometheus.GaugeValue, 1, name)
+	}
+
+	switch status.PowerSupplyBy {
+	case "Utility Power":
+		ch <- prometheus.MustNewConstMetric(powerSuppliedByDesc, prometheus.GaugeValue, 0, name)
+	case "Battery Power":
+		ch <- prometheus.MustNewConstMetric(powerSuppliedByDesc, prometheus.GaugeValue, 1, name)
+	}
+
+	if status.LineInteraction == "None" {
+		ch <- prometheus.MustNewConstMetric(lineInteractionDesc, prometheus.GaugeValue, 0, name)
+	} else {
+		ch <- prometheus.MustNewConstMetric(lineInteractionDesc, prometheus.GaugeValue, 1, name)
+	}
+
+	if status.TestResult == "Passed" {
+		ch <- prometheus.MustNewConstMetric(testResultDesc, prometheus.GaugeValue, 0, name)
+	} else {
+		ch <- prometheus.MustNewConstMetric(testResultDesc, prometheus.GaugeValue, 1, name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(utilityVoltageDesc, prometheus.GaugeValue, float64(status.UtilityVoltage), name)
+	ch <- prometheus.MustNewConstMetric(outputVoltageDesc, prometheus.GaugeValue, float64(status.OutputVoltage), name)
+	ch <- prometheus.MustNewConstMetric(batteryCapacityDesc, prometheus.GaugeValue, float64(status.BatteryCapacity), name)
+	ch <- prometheus.MustNewConstMetric(remainingRuntimeDesc, prometheus.GaugeValue, status.RemainingRuntime.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(loadWattsDesc, prometheus.GaugeValue, float64(status.LoadWatts), name)
+	ch <- prometheus.MustNewConstMetric(loadPctDesc, prometheus.GaugeValue, float64(status.LoadPct), name)
+	ch <- prometheus.MustNewConstMetric(lastPowerEventDurationDesc, prometheus.GaugeValue, status.LastPowerEventDuration.Seconds(), name)
+}
+
+// collectStateSet emits one series per known value, 1 for value and 0 for the
+// rest. A value we do not know sets the unknown series instead.
+func collectStateSet(ch chan<- prometheus.Metric, desc *prometheus.Desc, name, value string, known []string) {
+	var isKnown bool
+	for _, state := range known {
+		var val float64
+		if state == value {
+			val, isKnown = 1, true
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, name, state)
+	}
+
+	var unknown float64
+	if !isKnown {
+		unknown = 1
+	}
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, unknown, name, stateUnknown)
+}
+
+// unixSeconds converts t to fractional unix seconds.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
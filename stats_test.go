@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// nolint: gochecknoglobals
+var upsMetricNames = []string{
+	"cyber_power_exporter_state",
+	"cyber_power_exporter_power_supplied_by",
+	"cyber_power_exporter_utility_voltage",
+	"cyber_power_exporter_output_voltage",
+	"cyber_power_exporter_battery_capacity",
+	"cyber_power_exporter_remaining_runtime",
+	"cyber_power_exporter_load_watts",
+	"cyber_power_exporter_load_pct",
+	"cyber_power_exporter_line_interaction",
+	"cyber_power_exporter_test_result",
+	"cyber_power_exporter_last_power_event_duration",
+}
+
+func fakePwrstatSource(out string, err error) *pwrstatSource {
+	var source = newPwrstatSource("pwrstat", time.Second)
+	source.getStats = func(context.Context, string) (string, error) { return out, err }
+	return source
+}
+
+func TestUPSCollectorNormal(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(testOutputNormal, nil), time.Minute))
+
+	var expected = `
+# HELP cyber_power_exporter_battery_capacity Battery Capacity as %
+# TYPE cyber_power_exporter_battery_capacity gauge
+cyber_power_exporter_battery_capacity{ups="cyberpower"} 46
+# HELP cyber_power_exporter_last_power_event_duration how long the last event lasted
+# TYPE cyber_power_exporter_last_power_event_duration gauge
+cyber_power_exporter_last_power_event_duration{ups="cyberpower"} 3
+# HELP cyber_power_exporter_line_interaction ups line interaction
+# TYPE cyber_power_exporter_line_interaction gauge
+cyber_power_exporter_line_interaction{ups="cyberpower"} 0
+# HELP cyber_power_exporter_load_pct current load as %
+# TYPE cyber_power_exporter_load_pct gauge
+cyber_power_exporter_load_pct{ups="cyberpower"} 12
+# HELP cyber_power_exporter_load_watts Current Load in watts
+# TYPE cyber_power_exporter_load_watts gauge
+cyber_power_exporter_load_watts{ups="cyberpower"} 120
+# HELP cyber_power_exporter_output_voltage Output Voltage
+# TYPE cyber_power_exporter_output_voltage gauge
+cyber_power_exporter_output_voltage{ups="cyberpower"} 122
+# HELP cyber_power_exporter_power_supplied_by 0=Utility Power / 1=Battery Power
+# TYPE cyber_power_exporter_power_supplied_by gauge
+cyber_power_exporter_power_supplied_by{ups="cyberpower"} 0
+# HELP cyber_power_exporter_remaining_runtime Remaining Runtime on battery in seconds
+# TYPE cyber_power_exporter_remaining_runtime gauge
+cyber_power_exporter_remaining_runtime{ups="cyberpower"} 1680
+# HELP cyber_power_exporter_state 0=Normal / 1=Power Failure
+# TYPE cyber_power_exporter_state gauge
+cyber_power_exporter_state{ups="cyberpower"} 0
+# HELP cyber_power_exporter_test_result result of last test result
+# TYPE cyber_power_exporter_test_result gauge
+cyber_power_exporter_test_result{ups="cyberpower"} 0
+# HELP cyber_power_exporter_utility_voltage Utility Voltage
+# TYPE cyber_power_exporter_utility_voltage gauge
+cyber_power_exporter_utility_voltage{ups="cyberpower"} 122
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), upsMetricNames...))
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_up 1 if the last UPS read and parse succeeded, 0 otherwise
+# TYPE cyber_power_exporter_up gauge
+cyber_power_exporter_up{ups="cyberpower"} 1
+`), "cyber_power_exporter_up", "cyber_power_exporter_scrape_errors_total"))
+}
+
+func TestUPSCollectorDeviceInfo(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(testOutputNormal, nil), time.Minute))
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_device_info UPS model and firmware, always 1
+# TYPE cyber_power_exporter_device_info gauge
+cyber_power_exporter_device_info{firmware="CR01802B7H21",model_name="CP1500PFCLCDa",ups="cyberpower"} 1
+# HELP cyber_power_exporter_rating_power_va rated apparent power of the UPS in volt-amperes
+# TYPE cyber_power_exporter_rating_power_va gauge
+cyber_power_exporter_rating_power_va{ups="cyberpower"} 1500
+# HELP cyber_power_exporter_rating_power_watts rated real power of the UPS in watts
+# TYPE cyber_power_exporter_rating_power_watts gauge
+cyber_power_exporter_rating_power_watts{ups="cyberpower"} 1000
+# HELP cyber_power_exporter_rating_voltage_volts rated output voltage of the UPS
+# TYPE cyber_power_exporter_rating_voltage_volts gauge
+cyber_power_exporter_rating_voltage_volts{ups="cyberpower"} 120
+`), "cyber_power_exporter_device_info", "cyber_power_exporter_rating_voltage_volts",
+		"cyber_power_exporter_rating_power_watts", "cyber_power_exporter_rating_power_va"))
+}
+
+func TestUPSCollectorUnknownRating(t *testing.T) {
+	t.Parallel()
+
+	// a NUT driver that does not report the nominal values
+	var vars = map[string]string{}
+	for name, val := range testNUTVarsNormal {
+		vars[name] = val
+	}
+	delete(vars, "input.voltage.nominal")
+	delete(vars, "ups.power.nominal")
+	delete(vars, "ups.realpower.nominal")
+
+	var source = newNUTSource(fakeUPSD(t, "cyberpower", vars, ""), "cyberpower")
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", source, time.Minute))
+
+	assert.Equal(t, 1, testutil.CollectAndCount(collector, "cyber_power_exporter_device_info"))
+	assert.Equal(t, 0, testutil.CollectAndCount(collector, "cyber_power_exporter_rating_voltage_volts",
+		"cyber_power_exporter_rating_power_watts", "cyber_power_exporter_rating_power_va"))
+}
+
+func TestUPSCollectorEventTimestamps(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(testOutputNormal, nil), time.Minute))
+
+	// Passed at 2023/03/09 13:25:33, Blackout at 2023/03/09 12:55:09, both EST
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_last_power_event_info type of the last power event, always 1
+# TYPE cyber_power_exporter_last_power_event_info gauge
+cyber_power_exporter_last_power_event_info{type="Blackout",ups="cyberpower"} 1
+# HELP cyber_power_exporter_last_power_event_timestamp_seconds unix time the last power event started
+# TYPE cyber_power_exporter_last_power_event_timestamp_seconds gauge
+cyber_power_exporter_last_power_event_timestamp_seconds{ups="cyberpower"} 1.678384509e+09
+# HELP cyber_power_exporter_last_self_test_timestamp_seconds unix time of the last self test
+# TYPE cyber_power_exporter_last_self_test_timestamp_seconds gauge
+cyber_power_exporter_last_self_test_timestamp_seconds{ups="cyberpower"} 1.678386333e+09
+`), "cyber_power_exporter_last_power_event_info", "cyber_power_exporter_last_power_event_timestamp_seconds",
+		"cyber_power_exporter_last_self_test_timestamp_seconds"))
+
+	// no power event yet, only the self test has a time
+	var noEvent = strings.Replace(testOutputNormal, "Blackout at 2023/03/09 12:55:09 for 3 sec.", "None", 1)
+	collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(noEvent, nil), time.Minute))
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_last_power_event_info type of the last power event, always 1
+# TYPE cyber_power_exporter_last_power_event_info gauge
+cyber_power_exporter_last_power_event_info{type="None",ups="cyberpower"} 1
+`), "cyber_power_exporter_last_power_event_info", "cyber_power_exporter_last_power_event_timestamp_seconds"))
+}
+
+func TestUPSCollectorStateSets(t *testing.T) {
+	t.Parallel()
+
+	var failed = strings.Replace(testOutputBlackout, "Passed at", "Failed at", 1)
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(failed, nil), time.Minute))
+
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_communication_lost 1 if the UPS software lost communication with the UPS, 0 otherwise
+# TYPE cyber_power_exporter_communication_lost gauge
+cyber_power_exporter_communication_lost{ups="cyberpower"} 0
+# HELP cyber_power_exporter_power_supply_state 1 for what the UPS output is currently supplied by, 0 for the others
+# TYPE cyber_power_exporter_power_supply_state gauge
+cyber_power_exporter_power_supply_state{supply="Battery Power",ups="cyberpower"} 1
+cyber_power_exporter_power_supply_state{supply="Utility Power",ups="cyberpower"} 0
+cyber_power_exporter_power_supply_state{supply="unknown",ups="cyberpower"} 0
+# HELP cyber_power_exporter_test_result_state 1 for the result of the last self test, 0 for the others
+# TYPE cyber_power_exporter_test_result_state gauge
+cyber_power_exporter_test_result_state{result="Aborted",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="Error",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="Failed",ups="cyberpower"} 1
+cyber_power_exporter_test_result_state{result="In progress",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="None",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="Passed",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="Warning",ups="cyberpower"} 0
+cyber_power_exporter_test_result_state{result="unknown",ups="cyberpower"} 0
+# HELP cyber_power_exporter_ups_state 1 for the current UPS state, 0 for the others
+# TYPE cyber_power_exporter_ups_state gauge
+cyber_power_exporter_ups_state{state="Lost Communication",ups="cyberpower"} 0
+cyber_power_exporter_ups_state{state="Normal",ups="cyberpower"} 0
+cyber_power_exporter_ups_state{state="Power Failure",ups="cyberpower"} 1
+cyber_power_exporter_ups_state{state="unknown",ups="cyberpower"} 0
+`), "cyber_power_exporter_ups_state", "cyber_power_exporter_power_supply_state",
+		"cyber_power_exporter_test_result_state", "cyber_power_exporter_communication_lost"))
+}
+
+func TestUPSCollectorLostCommunication(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource(testLostConnection, nil), time.Minute))
+
+	// no zeroed readings, just the state
+	assert.Equal(t, 0, testutil.CollectAndCount(collector, upsMetricNames...))
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_communication_lost 1 if the UPS software lost communication with the UPS, 0 otherwise
+# TYPE cyber_power_exporter_communication_lost gauge
+cyber_power_exporter_communication_lost{ups="cyberpower"} 1
+# HELP cyber_power_exporter_ups_state 1 for the current UPS state, 0 for the others
+# TYPE cyber_power_exporter_ups_state gauge
+cyber_power_exporter_ups_state{state="Lost Communication",ups="cyberpower"} 1
+cyber_power_exporter_ups_state{state="Normal",ups="cyberpower"} 0
+cyber_power_exporter_ups_state{state="Power Failure",ups="cyberpower"} 0
+cyber_power_exporter_ups_state{state="unknown",ups="cyberpower"} 0
+`), "cyber_power_exporter_ups_state", "cyber_power_exporter_power_supply_state", "cyber_power_exporter_communication_lost"))
+}
+
+func TestUPSCollectorExecError(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", fakePwrstatSource("", errors.New("pwrstatd is not running")), 0))
+
+	assert.Equal(t, 0, testutil.CollectAndCount(collector, upsMetricNames...))
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_last_scrape_success_timestamp_seconds unix time of the last successful UPS read and parse
+# TYPE cyber_power_exporter_last_scrape_success_timestamp_seconds gauge
+cyber_power_exporter_last_scrape_success_timestamp_seconds{ups="cyberpower"} 0
+# HELP cyber_power_exporter_scrape_errors_total UPS read failures by stage and the getter that failed
+# TYPE cyber_power_exporter_scrape_errors_total counter
+cyber_power_exporter_scrape_errors_total{getter="getPowerStats",stage="exec",ups="cyberpower"} 2
+# HELP cyber_power_exporter_up 1 if the last UPS read and parse succeeded, 0 otherwise
+# TYPE cyber_power_exporter_up gauge
+cyber_power_exporter_up{ups="cyberpower"} 0
+`), "cyber_power_exporter_up", "cyber_power_exporter_scrape_errors_total", "cyber_power_exporter_last_scrape_success_timestamp_seconds"))
+}
+
+func TestUPSCollectorParseError(t *testing.T) {
+	t.Parallel()
+
+	var source = fakePwrstatSource(strings.Replace(testOutputNormal, "Watt(12 %)", "Watt", 1), nil)
+	var collector = NewUPSCollector(newUPSMonitor("cyberpower", source, 0))
+	assert.Equal(t, 0, testutil.CollectAndCount(collector, upsMetricNames...))
+
+	source.getStats = func(context.Context, string) (string, error) {
+		return strings.Replace(testOutputNormal, "Rating Voltage", "Rated Voltage", 1), nil
+	}
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_scrape_errors_total UPS read failures by stage and the getter that failed
+# TYPE cyber_power_exporter_scrape_errors_total counter
+cyber_power_exporter_scrape_errors_total{getter="getLoad",stage="parse_status",ups="cyberpower"} 1
+cyber_power_exporter_scrape_errors_total{getter="getRatingVoltage",stage="parse_device",ups="cyberpower"} 1
+`), "cyber_power_exporter_scrape_errors_total"))
+}
+
+func TestUPSCollectorCache(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	var source = newPwrstatSource("pwrstat", time.Second)
+	source.getStats = func(context.Context, string) (string, error) {
+		calls++
+		return testOutputBlackout, nil
+	}
+	var monitor = newUPSMonitor("cyberpower", source, time.Minute)
+	var collector = NewUPSCollector(monitor)
+
+	assert.Equal(t, 11, testutil.CollectAndCount(collector, upsMetricNames...))
+	assert.Equal(t, 11, testutil.CollectAndCount(collector, upsMetricNames...))
+	assert.Equal(t, 1, calls)
+
+	monitor.minInterval = 0
+	assert.Equal(t, 11, testutil.CollectAndCount(collector, upsMetricNames...))
+	assert.Equal(t, 2, calls)
+}
+
+func TestUPSCollectorMultipleUPS(t *testing.T) {
+	t.Parallel()
+
+	var collector = NewUPSCollector(
+		newUPSMonitor("rack1", fakePwrstatSource(testOutputNormal, nil), time.Minute),
+		newUPSMonitor("rack2", fakePwrstatSource(testOutputBlackout, nil), time.Minute),
+	)
+
+	// both UPSs are the same model, the ups label keeps them apart
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP cyber_power_exporter_battery_capacity Battery Capacity as %
+# TYPE cyber_power_exporter_battery_capacity gauge
+cyber_power_exporter_battery_capacity{ups="rack1"} 46
+cyber_power_exporter_battery_capacity{ups="rack2"} 39
+# HELP cyber_power_exporter_device_info UPS model and firmware, always 1
+# TYPE cyber_power_exporter_device_info gauge
+cyber_power_exporter_device_info{firmware="CR01802B7H21",model_name="CP1500PFCLCDa",ups="rack1"} 1
+cyber_power_exporter_device_info{firmware="CR01802B7H21",model_name="CP1500PFCLCDa",ups="rack2"} 1
+`), "cyber_power_exporter_battery_capacity", "cyber_power_exporter_device_info"))
+}
@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+// statusDocument is the JSON form of a UPS reading handed to hooks and other
+// consumers outside of prometheus. Durations are in seconds and times are
+// omitted when the UPS does not report them.
+type statusDocument struct {
+	UPS                           string     `json:"ups"`
+	ModelName                     string     `json:"model_name"`
+	Firmware                      string     `json:"firmware"`
+	RatingVoltage                 int        `json:"rating_voltage_volts"`
+	RatingPowerWatts              int        `json:"rating_power_watts"`
+	RatingPowerVA                 int        `json:"rating_power_va"`
+	State                         string     `json:"state"`
+	PowerSupplyBy                 string     `json:"power_supply_by"`
+	UtilityVoltage                int        `json:"utility_voltage"`
+	OutputVoltage                 int        `json:"output_voltage"`
+	BatteryCapacity               int        `json:"battery_capacity"`
+	RemainingRuntimeSeconds       float64    `json:"remaining_runtime_seconds"`
+	LoadWatts                     int        `json:"load_watts"`
+	LoadPct                       int        `json:"load_pct"`
+	LineInteraction               string     `json:"line_interaction"`
+	TestResult                    string     `json:"test_result"`
+	TestResultTime                *time.Time `json:"test_result_time,omitempty"`
+	LastPowerEvent                string     `json:"last_power_event"`
+	LastPowerEventTime            *time.Time `json:"last_power_event_time,omitempty"`
+	LastPowerEventDurationSeconds float64    `json:"last_power_event_duration_seconds"`
+	CollectionTime                time.Time  `json:"collection_time"`
+}
+
+func newStatusDocument(ups string, device Device, status DeviceStatus) statusDocument {
+	return statusDocument{
+		UPS:                           ups,
+		ModelName:                     device.ModelName,
+		Firmware:                      device.FirmwareNumber,
+		RatingVoltage:                 device.RatingVoltage,
+		RatingPowerWatts:              device.RatingPowerWatts,
+		RatingPowerVA:                 device.RatingPowerVA,
+		State:                         status.State,
+		PowerSupplyBy:                 status.PowerSupplyBy,
+		UtilityVoltage:                status.UtilityVoltage,
+		OutputVoltage:                 status.OutputVoltage,
+		BatteryCapacity:               status.BatteryCapacity,
+		RemainingRuntimeSeconds:       status.RemainingRuntime.Seconds(),
+		LoadWatts:                     status.LoadWatts,
+		LoadPct:                       status.LoadPct,
+		LineInteraction:               status.LineInteraction,
+		TestResult:                    status.TestResult,
+		TestResultTime:                optionalTime(status.TestResultTime),
+		LastPowerEvent:                status.LastPowerEvent,
+		LastPowerEventTime:            optionalTime(status.LastPowerEventTime),
+		LastPowerEventDurationSeconds: status.LastPowerEventDuration.Seconds(),
+		CollectionTime:                status.CollectionTime,
+	}
+}
+
+// optionalTime returns nil for the zero time so it is left out of the JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// streamHeartbeat is how often an idle stream gets a comment so proxies do
+// not time it out.
+const streamHeartbeat = 15 * time.Second
+
+// streamSubscriberBuffer is how many messages a slow subscriber may fall
+// behind before messages to it are dropped.
+const streamSubscriberBuffer = 16
+
+// The SSE event types of /api/v1/stream.
+const (
+	streamStatus     = "status"
+	streamTransition = "transition"
+)
+
+// streamTransitions are the events sent as transition, the ones where the
+// state or power source of a UPS changed.
+// nolint: gochecknoglobals
+var streamTransitions = map[string]bool{
+	eventPowerFailure:          true,
+	eventPowerRestored:         true,
+	eventOnBattery:             true,
+	eventOnUtility:             true,
+	eventCommunicationLost:     true,
+	eventCommunicationRestored: true,
+}
+
+// streamTransitionData is the data of a transition event.
+type streamTransitionData struct {
+	Event                 string    `json:"event"`
+	UPS                   string    `json:"ups"`
+	Time                  time.Time `json:"time"`
+	State                 string    `json:"state"`
+	PreviousState         string    `json:"previous_state"`
+	PowerSupplyBy         string    `json:"power_supply_by"`
+	PreviousPowerSupplyBy string    `json:"previous_power_supply_by"`
+}
+
+// streamBroadcaster fans UPS readings and transitions out to every
+// /api/v1/stream subscriber as Server-Sent Events. status events carry a
+// statusDocument, transition events a streamTransitionData.
+type streamBroadcaster struct {
+	heartbeat time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newStreamBroadcaster() *streamBroadcaster {
+	return &streamBroadcaster{heartbeat: streamHeartbeat, subscribers: map[chan []byte]struct{}{}}
+}
+
+// observe is a upsMonitor observer, failed reads are not streamed.
+func (b *streamBroadcaster) observe(reading upsReading) {
+	if reading.err != nil {
+		return
+	}
+	b.broadcast(streamStatus, newStatusDocument(reading.ups, reading.device, reading.status))
+}
+
+// transition is an eventDetector handler.
+func (b *streamBroadcaster) transition(event upsEvent) {
+	if !streamTransitions[event.name] {
+		return
+	}
+	b.broadcast(streamTransition, streamTransitionData{
+		Event:                 event.name,
+		UPS:                   event.ups,
+		Time:                  event.time,
+		State:                 event.status.State,
+		PreviousState:         event.previous.State,
+		PowerSupplyBy:         event.status.PowerSupplyBy,
+		PreviousPowerSupplyBy: event.previous.PowerSupplyBy,
+	})
+}
+
+// broadcast sends an event to every subscriber without blocking, subscribers
+// that are too far behind miss it.
+func (b *streamBroadcaster) broadcast(eventType string, data any) {
+	var encoded, err = json.Marshal(data)
+	if err != nil {
+		log.Errorf("unable to encode %s stream event, err: %s", eventType, err)
+		return
+	}
+	var message = fmt.Appendf(nil, "event: %s\ndata: %s\n\n", eventType, encoded)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			log.Warnf("a stream subscriber is too slow, dropping a %s event", eventType)
+		}
+	}
+}
+
+func (b *streamBroadcaster) subscribe() chan []byte {
+	var subscriber = make(chan []byte, streamSubscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (b *streamBroadcaster) unsubscribe(subscriber chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, subscriber)
+}
+
+// ServeHTTP streams events to the client until it goes away.
+func (b *streamBroadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rc = http.NewResponseController(w)
+	// the server's write timeout is meant for scrapes, not for streams
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debugf("unable to clear the stream write deadline: %s", err)
+	}
+
+	var subscriber = b.subscribe()
+	defer b.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Errorf("unable to stream, err: %s", err)
+		return
+	}
+
+	var heartbeat = time.NewTicker(b.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var message []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			message = []byte(": heartbeat\n\n")
+		case message = <-subscriber:
+		}
+
+		if _, err := w.Write(message); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
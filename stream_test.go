@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readStreamEvent reads the next event off an SSE stream, returning its type
+// and data. Comments are returned as a "comment" event.
+func readStreamEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var eventType, data string
+	for {
+		var line, err = reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return "", ""
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return eventType, data
+		case strings.HasPrefix(line, ":"):
+			eventType, data = "comment", strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func subscribeStream(t *testing.T, ctx context.Context, url string) *bufio.Reader {
+	t.Helper()
+
+	var req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+func TestStreamBroadcaster(t *testing.T) {
+	t.Parallel()
+
+	var stream = newStreamBroadcaster()
+	var events = newEventDetector(20)
+	events.handle(stream.transition)
+
+	var out = testOutputNormal
+	var source = fakePwrstatSource("", nil)
+	source.getStats = func(context.Context, string) (string, error) { return out, nil }
+	var monitor = newUPSMonitor("rack1", source, 0)
+	monitor.observe(stream.observe)
+	monitor.observe(events.observe)
+
+	var server = httptest.NewServer(stream)
+	t.Cleanup(server.Close)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var first = subscribeStream(t, ctx, server.URL)
+	var second = subscribeStream(t, ctx, server.URL)
+	assert.Eventually(t, func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return len(stream.subscribers) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	monitor.update()
+	out = testOutputBlackout
+	monitor.update()
+
+	for _, reader := range []*bufio.Reader{first, second} {
+		var eventType, data = readStreamEvent(t, reader)
+		assert.Equal(t, streamStatus, eventType)
+		var doc statusDocument
+		assert.NoError(t, json.Unmarshal([]byte(data), &doc))
+		assert.Equal(t, "Normal", doc.State)
+
+		eventType, data = readStreamEvent(t, reader)
+		assert.Equal(t, streamStatus, eventType)
+		assert.NoError(t, json.Unmarshal([]byte(data), &doc))
+		assert.Equal(t, "Power Failure", doc.State)
+
+		var transitions []streamTransitionData
+		for range 2 {
+			eventType, data = readStreamEvent(t, reader)
+			assert.Equal(t, streamTransition, eventType)
+			var transition streamTransitionData
+			assert.NoError(t, json.Unmarshal([]byte(data), &transition))
+			transitions = append(transitions, transition)
+		}
+		assert.Equal(t, eventPowerFailure, transitions[0].Event)
+		assert.Equal(t, "Normal", transitions[0].PreviousState)
+		assert.Equal(t, "Power Failure", transitions[0].State)
+		assert.Equal(t, eventOnBattery, transitions[1].Event)
+		assert.Equal(t, "Utility Power", transitions[1].PreviousPowerSupplyBy)
+		assert.Equal(t, "Battery Power", transitions[1].PowerSupplyBy)
+	}
+
+	// subscribers go away with their connection
+	cancel()
+	assert.Eventually(t, func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return len(stream.subscribers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	var stream = newStreamBroadcaster()
+	stream.heartbeat = 10 * time.Millisecond
+	var server = httptest.NewServer(stream)
+	t.Cleanup(server.Close)
+
+	var eventType, data = readStreamEvent(t, subscribeStream(t, context.Background(), server.URL))
+	assert.Equal(t, "comment", eventType)
+	assert.Equal(t, "heartbeat", data)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errInvalidUPSFlag = errors.New("invalid -ups value")
+	errDuplicateUPS   = errors.New("duplicate ups name")
+)
+
+// upsConfig describes one UPS instance, its user assigned name is the ups
+// label on every metric.
+type upsConfig struct {
+	name        string
+	kind        string
+	source      sourceConfig
+	minInterval time.Duration
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseUPSFlags parses every -ups value, ups names must be unique.
+func parseUPSFlags(values []string, defaults sourceConfig, minInterval time.Duration) ([]upsConfig, error) {
+	var configs = make([]upsConfig, 0, len(values))
+	var seen = map[string]bool{}
+	for _, value := range values {
+		var config, err = parseUPSFlag(value, defaults, minInterval)
+		if err != nil {
+			return nil, err
+		}
+		if seen[config.name] {
+			return nil, fmt.Errorf("%w: %s", errDuplicateUPS, config.name)
+		}
+		seen[config.name] = true
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// parseUPSFlag parses a single -ups value of the form
+// name=kind[,option=value...], e.g. rack1=nut,addr=10.0.0.2:3493,ups=cp1500.
+// Options not given fall back to defaults.
+func parseUPSFlag(value string, defaults sourceConfig, minInterval time.Duration) (upsConfig, error) {
+	var name, rest, found = strings.Cut(value, "=")
+	if !found || name == "" {
+		return upsConfig{}, fmt.Errorf("%w: %q, expected name=kind[,option=value...]", errInvalidUPSFlag, value)
+	}
+
+	var parts = strings.Split(rest, ",")
+	var config = upsConfig{name: name, kind: parts[0], source: defaults, minInterval: minInterval}
+
+	for _, option := range parts[1:] {
+		var key, val, found = strings.Cut(option, "=")
+		if !found {
+			return upsConfig{}, fmt.Errorf("%w: %q, option %q is not key=value", errInvalidUPSFlag, value, option)
+		}
+
+		switch key {
+		case "cmd-path":
+			config.source.cmdPath = val
+		case "exec-timeout":
+			var timeout, err = time.ParseDuration(val)
+			if err != nil {
+				return upsConfig{}, fmt.Errorf("%w: %q, bad exec-timeout: %w", errInvalidUPSFlag, value, err)
+			}
+			config.source.execTimeout = timeout
+		case "device":
+			config.source.hidDevice = val
+		case "addr":
+			config.source.nutAddr = val
+		case "ups":
+			config.source.nutUPS = val
+		case "replay":
+			config.source.replayPath = val
+		case "replay-speed":
+			var speed, err = strconv.ParseFloat(val, 64)
+			if err != nil {
+				return upsConfig{}, fmt.Errorf("%w: %q, bad replay-speed: %w", errInvalidUPSFlag, value, err)
+			}
+			config.source.replaySpeed = speed
+		case "interval":
+			var interval, err = time.ParseDuration(val)
+			if err != nil {
+				return upsConfig{}, fmt.Errorf("%w: %q, bad interval: %w", errInvalidUPSFlag, value, err)
+			}
+			config.minInterval = interval
+		default:
+			return upsConfig{}, fmt.Errorf("%w: %q, unknown option %q", errInvalidUPSFlag, value, key)
+		}
+	}
+
+	return config, nil
+}
+
+// scrapeErrorKey is the stage and getter of a counted scrape error.
+type scrapeErrorKey struct {
+	stage  string
+	getter string
+}
+
+// upsReading is a fresh reading of a UPS as handed to observers.
+type upsReading struct {
+	ups    string
+	device Device
+	status DeviceStatus
+	err    error
+}
+
+// upsMonitor reads a single UPS from its Source. Results are cached for
+// minInterval so rapid or concurrent readers do not hammer the device, each
+// UPS is cached and locked independently.
+type upsMonitor struct {
+	name        string
+	source      Source
+	minInterval time.Duration
+
+	// notifyMu is held from a fetch until its reading has been handed to the
+	// observers so they see readings in the order they were taken
+	notifyMu sync.Mutex
+
+	mu             sync.Mutex
+	lastFetch      time.Time
+	lastSuccess    time.Time
+	scrapeDuration time.Duration
+	device         Device
+	status         DeviceStatus
+	err            error
+	scrapeErrors   map[scrapeErrorKey]float64
+	counters       upsCounters
+	meter          upsMeter
+	observers      []func(upsReading)
+}
+
+func newUPSMonitor(name string, source Source, minInterval time.Duration) *upsMonitor {
+	return &upsMonitor{
+		name:         name,
+		source:       source,
+		minInterval:  minInterval,
+		scrapeErrors: map[scrapeErrorKey]float64{},
+	}
+}
+
+// upsSnapshot is a copy of a monitor's state.
+type upsSnapshot struct {
+	device         Device
+	status         DeviceStatus
+	err            error
+	lastSuccess    time.Time
+	scrapeDuration time.Duration
+	scrapeErrors   map[scrapeErrorKey]float64
+	counters       upsCounters
+	energyPriced   bool
+}
+
+// observe calls fn with every fresh reading of the UPS, it must be registered
+// before the monitor is used. fn is called without the monitor locked but must
+// not block or read the UPS through the monitor, readers wait for it.
+func (m *upsMonitor) observe(fn func(upsReading)) {
+	m.observers = append(m.observers, fn)
+}
+
+// update reads the UPS if the cached reading is older than minInterval and
+// hands a fresh reading to the observers.
+func (m *upsMonitor) update() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var reading, fetched = m.refresh()
+	m.mu.Unlock()
+
+	if fetched {
+		m.notify(reading)
+	}
+}
+
+// forceUpdate reads the UPS regardless of the age of the cached reading and
+// hands it to the observers.
+func (m *upsMonitor) forceUpdate() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var reading = m.fetch()
+	m.mu.Unlock()
+
+	m.notify(reading)
+}
+
+// notify hands a reading to the observers, the caller must hold m.notifyMu but
+// not m.mu.
+func (m *upsMonitor) notify(reading upsReading) {
+	for _, fn := range m.observers {
+		fn(reading)
+	}
+}
+
+// snapshot returns the monitor's state, reading the UPS first if the cached
+// reading is older than minInterval.
+func (m *upsMonitor) snapshot() upsSnapshot {
+	m.update()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var scrapeErrors = make(map[scrapeErrorKey]float64, len(m.scrapeErrors))
+	for key, count := range m.scrapeErrors {
+		scrapeErrors[key] = count
+	}
+
+	return upsSnapshot{
+		device:         m.device,
+		status:         m.status,
+		err:            m.err,
+		lastSuccess:    m.lastSuccess,
+		scrapeDuration: m.scrapeDuration,
+		scrapeErrors:   scrapeErrors,
+		counters:       m.counters.clone(),
+		energyPriced:   m.meter.pricePerKWh > 0,
+	}
+}
+
+// snapshotCounters returns the totals to persist.
+func (m *upsMonitor) snapshotCounters() upsCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters.clone()
+}
+
+// restoreCounters continues counting from totals persisted by an earlier run.
+func (m *upsMonitor) restoreCounters(counters upsCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters = counters
+}
+
+// reconfigure switches the monitor to a new source and interval, the totals
+// are kept. The next read uses the new source.
+func (m *upsMonitor) reconfigure(source Source, minInterval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.source, m.minInterval = source, minInterval
+	m.lastFetch = time.Time{}
+	m.meter.reset()
+}
+
+// setEnergyPrice changes the price energy cost is counted at from now on.
+func (m *upsMonitor) setEnergyPrice(pricePerKWh float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.meter.pricePerKWh = pricePerKWh
+}
+
+func (m *upsMonitor) interval() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.minInterval
+}
+
+// poll reads the UPS every minInterval until ctx is done, so readings and the
+// totals derived from them keep up even when nobody is scraping. It stops if
+// minInterval is not positive.
+func (m *upsMonitor) poll(ctx context.Context) {
+	var interval = m.interval()
+	if interval <= 0 {
+		return
+	}
+
+	var timer = time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		// a scrape since the last tick may have moved lastFetch, going
+		// through refresh would skip this tick
+		m.forceUpdate()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if interval = m.interval(); interval <= 0 {
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Latest returns the most recent reading of the UPS, reading it first if the
+// cached one is older than minInterval.
+func (m *upsMonitor) Latest() (Device, DeviceStatus, error) {
+	m.update()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.device, m.status, m.err
+}
+
+// refresh fetches new stats if the cached result is older than minInterval and
+// returns the reading if it did. The caller must hold m.mu.
+func (m *upsMonitor) refresh() (upsReading, bool) {
+	if !m.lastFetch.IsZero() && time.Since(m.lastFetch) < m.minInterval {
+		return upsReading{}, false
+	}
+	return m.fetch(), true
+}
+
+// fetch reads the UPS regardless of the age of the cached result.
+// The caller must hold m.mu.
+func (m *upsMonitor) fetch() upsReading {
+	var start = time.Now()
+	m.lastFetch = start
+
+	var device, status, err = m.source.Fetch(context.Background())
+	m.scrapeDuration = time.Since(start)
+	m.err = err
+	if err != nil {
+		var key = scrapeErrorKey{stage: stageExec, getter: "unknown"}
+		var sErr *scrapeError
+		if errors.As(err, &sErr) {
+			key = scrapeErrorKey{stage: sErr.stage, getter: sErr.getter}
+		}
+		m.scrapeErrors[key]++
+		m.meter.reset()
+		log.Errorf("ups %s: %s", m.name, err)
+		return upsReading{ups: m.name, err: err}
+	}
+
+	m.device, m.status, m.lastSuccess = device, status, start
+
+	if status.State == "Lost Communication" {
+		m.meter.reset()
+	} else {
+		m.meter.add(&m.counters, status)
+	}
+	return upsReading{ups: m.name, device: device, status: status}
+}
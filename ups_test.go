@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUPSFlags(t *testing.T) {
+	t.Parallel()
+
+	var defaults = sourceConfig{cmdPath: "/usr/sbin/pwrstat", nutAddr: "localhost:3493"}
+
+	var configs, err = parseUPSFlags([]string{
+		"rack1=pwrstat",
+		"rack2=nut,addr=10.0.0.2:3493,ups=cp1500,interval=30s",
+		"desk=hid,device=/dev/hidraw1",
+		"bug123=replay,replay=captures.tar.gz,replay-speed=0",
+	}, defaults, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []upsConfig{
+		{name: "rack1", kind: "pwrstat", source: defaults, minInterval: 5 * time.Second},
+		{name: "rack2", kind: "nut", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", nutAddr: "10.0.0.2:3493", nutUPS: "cp1500"}, minInterval: 30 * time.Second},
+		{name: "desk", kind: "hid", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", hidDevice: "/dev/hidraw1", nutAddr: "localhost:3493"}, minInterval: 5 * time.Second},
+		{name: "bug123", kind: "replay", source: sourceConfig{cmdPath: "/usr/sbin/pwrstat", nutAddr: "localhost:3493", replayPath: "captures.tar.gz"}, minInterval: 5 * time.Second},
+	}, configs)
+
+	for _, values := range [][]string{
+		{"pwrstat"},
+		{"=pwrstat"},
+		{"rack1=nut,addr"},
+		{"rack1=nut,port=3493"},
+		{"rack1=pwrstat,interval=soon"},
+		{"rack1=replay,replay-speed=fast"},
+	} {
+		_, err = parseUPSFlags(values, defaults, time.Second)
+		assert.ErrorIs(t, err, errInvalidUPSFlag, values)
+	}
+
+	_, err = parseUPSFlags([]string{"rack1=pwrstat", "rack1=hid"}, defaults, time.Second)
+	assert.ErrorIs(t, err, errDuplicateUPS)
+}
+
+func TestUPSMonitorPoll(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	var source = newPwrstatSource("pwrstat", time.Second)
+	source.getStats = func(context.Context, string) (string, error) {
+		calls.Add(1)
+		return testOutputNormal, nil
+	}
+	var monitor = newUPSMonitor("cyberpower", source, time.Hour)
+
+	// a scrape just read the UPS, poll still reads it right away
+	monitor.snapshot()
+	assert.Equal(t, int32(1), calls.Load())
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go monitor.poll(ctx)
+
+	assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 10*time.Millisecond)
+}
+
+// clockSource reports a reading taken at the time it is read.
+type clockSource struct{}
+
+func (clockSource) Fetch(context.Context) (Device, DeviceStatus, error) {
+	return Device{}, DeviceStatus{State: "Normal", CollectionTime: time.Now()}, nil
+}
+
+func TestUPSMonitorNotifyOrder(t *testing.T) {
+	t.Parallel()
+
+	var monitor = newUPSMonitor("cyberpower", clockSource{}, 0)
+
+	// observers are never called concurrently so times needs no lock, the
+	// race detector catches it if they are
+	var times []time.Time
+	monitor.observe(func(reading upsReading) {
+		times = append(times, reading.status.CollectionTime)
+	})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				monitor.update()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				monitor.forceUpdate()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, times, 800)
+	for i := 1; i < len(times); i++ {
+		assert.False(t, times[i].Before(times[i-1]), "reading %d is older than the one before it", i)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// serveHTTP serves server on listener. If webConfigFile is set it is a
+// Prometheus web config file, as used by node_exporter's --web.config.file,
+// with the TLS, client CA and bcrypt basic auth settings to serve with. The
+// file is read again for every new connection so certificate renewals and
+// user changes need no restart.
+func serveHTTP(listener net.Listener, server *http.Server, webConfigFile string) error {
+	var addresses = []string{listener.Addr().String()}
+	var systemdSocket = false
+	return web.Serve(listener, server, &web.FlagConfig{
+		WebListenAddresses: &addresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}, slog.Default())
+}
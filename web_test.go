@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testCert is a certificate and key written to PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate for 127.0.0.1, signed by parent or self
+// signed if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) testCert {
+	t.Helper()
+
+	var key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	var parentCert, parentKey = template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	var dir = t.TempDir()
+	var tc = testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	assert.NoError(t, os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return tc
+}
+
+// startWebServer serves a handler answering "ok" with the web config and
+// returns its address.
+func startWebServer(t *testing.T, webConfig string) string {
+	t.Helper()
+
+	var webConfigFile = writeConfigFile(t, webConfig)
+	assert.NoError(t, web.Validate(webConfigFile))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	var server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() { _ = serveHTTP(listener, server, webConfigFile) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return listener.Addr().String()
+}
+
+func getWithAuth(t *testing.T, client *http.Client, url, username, password string) (int, error) {
+	t.Helper()
+
+	var req, err = http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestServeHTTPTLSAndBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	var server = newTestCert(t, "server", true, nil)
+	var hash, err = bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	var addr = startWebServer(t, fmt.Sprintf(`
+tls_server_config:
+  cert_file: %s
+  key_file: %s
+basic_auth_users:
+  prometheus: %s
+`, server.certFile, server.keyFile, hash))
+
+	var roots = x509.NewCertPool()
+	roots.AddCert(server.cert)
+	var client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}}
+
+	code, err := getWithAuth(t, client, "https://"+addr+"/metrics", "prometheus", "hunter2")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, err = getWithAuth(t, client, "https://"+addr+"/metrics", "prometheus", "wrong")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, err = getWithAuth(t, client, "https://"+addr+"/metrics", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// plain http is refused
+	code, err = getWithAuth(t, http.DefaultClient, "http://"+addr+"/metrics", "prometheus", "hunter2")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestServeHTTPClientCerts(t *testing.T) {
+	t.Parallel()
+
+	var ca = newTestCert(t, "ca", true, nil)
+	var server = newTestCert(t, "server", false, &ca)
+	var client = newTestCert(t, "client", false, &ca)
+	var addr = startWebServer(t, fmt.Sprintf(`
+tls_server_config:
+  cert_file: %s
+  key_file: %s
+  client_ca_file: %s
+  client_auth_type: RequireAndVerifyClientCert
+`, server.certFile, server.keyFile, ca.certFile))
+
+	var roots = x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	var clientKeyPair, err = tls.LoadX509KeyPair(client.certFile, client.keyFile)
+	assert.NoError(t, err)
+
+	var withCert = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots, Certificates: []tls.Certificate{clientKeyPair}, MinVersion: tls.VersionTLS12,
+	}}}
+	code, err := getWithAuth(t, withCert, "https://"+addr+"/metrics", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	var withoutCert = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}}
+	_, err = getWithAuth(t, withoutCert, "https://"+addr+"/metrics", "", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var errWebhookStatus = errors.New("webhook returned an error")
+
+// defaultWebhookTemplate is a Slack compatible body, Discord wants "content",
+// Gotify "message" and ntfy takes the plain {{.Message}}.
+const defaultWebhookTemplate = `{"text": {{json .Message}}}`
+
+// defaultWebhookEvents are the events worth waking someone up for,
+// power_failure and power_restored repeat on_battery and on_utility.
+const defaultWebhookEvents = "on_battery,on_utility,low_battery,communication_lost,communication_restored,self_test_failed"
+
+// webhookQueueSize is how many notifications may wait to be sent before new
+// ones are dropped.
+const webhookQueueSize = 64
+
+// The results of a notification.
+const (
+	webhookSent       = "sent"
+	webhookFailed     = "failed"
+	webhookSuppressed = "suppressed"
+)
+
+// nolint: gochecknoglobals
+var webhookNotificationsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(promNamespace, "", "webhook_notifications_total"),
+	"webhook notifications by result, failed ones were given up on after retrying",
+	[]string{"result"}, nil,
+)
+
+// notification is the data a webhook template is rendered with.
+type notification struct {
+	Event    string
+	UPS      string
+	Time     time.Time
+	Device   Device
+	Status   DeviceStatus
+	Previous DeviceStatus
+	// OutageDuration is how long the UPS was on battery, set on on_utility.
+	OutageDuration time.Duration
+	// Message is a human readable summary of the event.
+	Message string
+}
+
+// webhookConfig configures a webhookNotifier.
+type webhookConfig struct {
+	urls        []string
+	template    string        // text/template of the request body
+	contentType string        // of the request body
+	events      []string      // events to notify about
+	dedup       time.Duration // suppress repeats of an event of a UPS within this window
+	retries     int           // retries of a failed request
+	backoff     time.Duration // before the first retry, doubled for each one after
+}
+
+// webhookNotifier POSTs a templated body to each webhook URL on UPS events.
+// It is a prometheus.Collector for the notification results.
+type webhookNotifier struct {
+	client *http.Client
+	queue  chan notification
+	now    func() time.Time // dedup clock, event times come from the UPS and may be missing
+
+	mu             sync.Mutex
+	config         webhookConfig
+	template       *template.Template
+	events         map[string]bool
+	lastSent       map[string]time.Time // ups + event
+	onBatterySince map[string]time.Time // ups
+	results        map[string]float64
+}
+
+func newWebhookNotifier(config webhookConfig) (*webhookNotifier, error) {
+	var w = &webhookNotifier{
+		client:         &http.Client{Timeout: 10 * time.Second},
+		queue:          make(chan notification, webhookQueueSize),
+		now:            time.Now,
+		lastSent:       map[string]time.Time{},
+		onBatterySince: map[string]time.Time{},
+		results:        map[string]float64{},
+	}
+	if err := w.reconfigure(config); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// reconfigure replaces the notifier's config, what it remembers of earlier
+// events is kept.
+func (w *webhookNotifier) reconfigure(config webhookConfig) error {
+	var tmpl, err = parseWebhookTemplate(config.template)
+	if err != nil {
+		return err
+	}
+	w.setConfig(config, tmpl)
+	return nil
+}
+
+// setConfig is reconfigure with the template of config already parsed.
+func (w *webhookNotifier) setConfig(config webhookConfig, tmpl *template.Template) {
+	var events = make(map[string]bool, len(config.events))
+	for _, event := range config.events {
+		events[event] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.config, w.template, w.events = config, tmpl, events
+}
+
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	var tmpl, err = template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			var encoded, err = json.Marshal(v)
+			return string(encoded), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse webhook template, err: %w", err)
+	}
+	return tmpl, nil
+}
+
+// enqueue is an eventDetector handler.
+func (w *webhookNotifier) enqueue(event upsEvent) {
+	w.mu.Lock()
+	var enabled = len(w.config.urls) > 0
+	w.mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	var note, ok = w.notification(event)
+	if !ok {
+		return
+	}
+
+	select {
+	case w.queue <- note:
+	default:
+		log.Errorf("ups %s: too many webhook notifications queued, dropping %s", event.ups, event.name)
+	}
+}
+
+// run sends queued notifications until ctx is done.
+func (w *webhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case note := <-w.queue:
+			w.send(ctx, note)
+		}
+	}
+}
+
+// notification turns event into a notification, or returns false if it
+// should not be sent.
+func (w *webhookNotifier) notification(event upsEvent) (notification, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var note = notification{
+		Event:    event.name,
+		UPS:      event.ups,
+		Time:     event.time,
+		Device:   event.device,
+		Status:   event.status,
+		Previous: event.previous,
+	}
+
+	// outages are tracked whether or not they are notified about
+	switch event.name {
+	case eventOnBattery:
+		w.onBatterySince[event.ups] = event.time
+	case eventOnUtility:
+		if since, ok := w.onBatterySince[event.ups]; ok {
+			note.OutageDuration = event.time.Sub(since)
+			delete(w.onBatterySince, event.ups)
+		}
+	}
+
+	if !w.events[event.name] {
+		return note, false
+	}
+
+	var key, now = event.ups + "/" + event.name, w.now()
+	if last, ok := w.lastSent[key]; ok && now.Sub(last) < w.config.dedup {
+		w.results[webhookSuppressed]++
+		log.Infof("ups %s: suppressing repeated %s webhook", event.ups, event.name)
+		return note, false
+	}
+	w.lastSent[key] = now
+
+	note.Message = webhookMessage(note)
+	return note, true
+}
+
+// send renders note and POSTs it to every webhook.
+func (w *webhookNotifier) send(ctx context.Context, note notification) {
+	w.mu.Lock()
+	var config, tmpl = w.config, w.template
+	w.mu.Unlock()
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, note); err != nil {
+		log.Errorf("unable to render webhook template, err: %s", err)
+		w.count(webhookFailed)
+		return
+	}
+
+	for _, webhookURL := range config.urls {
+		if err := w.post(ctx, config, webhookURL, body.Bytes()); err != nil {
+			log.Errorf("ups %s: giving up on %s webhook: %s", note.UPS, note.Event, err)
+			w.count(webhookFailed)
+			continue
+		}
+		w.count(webhookSent)
+	}
+}
+
+// post POSTs body to url, retrying with backoff on network errors, 429s and
+// 5xx responses.
+func (w *webhookNotifier) post(ctx context.Context, config webhookConfig, webhookURL string, body []byte) error {
+	var backoff = config.backoff
+	var err error
+	for attempt := 0; attempt <= config.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("unable to send webhook, err: %w", ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var retry bool
+		retry, err = w.postOnce(ctx, config.contentType, webhookURL, body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (w *webhookNotifier) postOnce(ctx context.Context, contentType, webhookURL string, body []byte) (bool, error) {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("unable to build webhook request, err: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// leave out the url, it may carry a token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, fmt.Errorf("unable to send webhook, err: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("%w: %s", errWebhookStatus, resp.Status)
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return false, fmt.Errorf("%w: %s", errWebhookStatus, resp.Status)
+	default:
+		return false, nil
+	}
+}
+
+func (w *webhookNotifier) count(result string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.results[result]++
+}
+
+// Describe implements prometheus.Collector.
+func (w *webhookNotifier) Describe(ch chan<- *prometheus.Desc) {
+	ch <- webhookNotificationsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (w *webhookNotifier) Collect(ch chan<- prometheus.Metric) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for result, count := range w.results {
+		ch <- prometheus.MustNewConstMetric(webhookNotificationsDesc, prometheus.CounterValue, count, result)
+	}
+}
+
+// webhookMessage is the default human readable text of a notification.
+func webhookMessage(note notification) string {
+	var name = note.UPS
+	if note.Device.ModelName != "" {
+		name = fmt.Sprintf("%s (%s)", note.UPS, note.Device.ModelName)
+	}
+
+	switch note.Event {
+	case eventOnBattery:
+		return fmt.Sprintf("%s is on battery, %d%% battery and %s runtime left",
+			name, note.Status.BatteryCapacity, note.Status.RemainingRuntime)
+	case eventOnUtility:
+		if note.OutageDuration > 0 {
+			return fmt.Sprintf("%s is back on utility power after %s on battery", name, note.OutageDuration.Truncate(time.Second))
+		}
+		return name + " is back on utility power"
+	case eventLowBattery:
+		return fmt.Sprintf("%s battery is low, %d%% battery and %s runtime left",
+			name, note.Status.BatteryCapacity, note.Status.RemainingRuntime)
+	case eventCommunicationLost:
+		return name + " lost communication with the UPS"
+	case eventCommunicationRestored:
+		return name + " communication with the UPS is restored"
+	case eventSelfTestFailed:
+		return fmt.Sprintf("%s self test result: %s", name, note.Status.TestResult)
+	case eventPowerFailure:
+		return name + " reports a power failure"
+	case eventPowerRestored:
+		return name + " reports power is restored"
+	default:
+		return fmt.Sprintf("%s: %s", name, strings.ReplaceAll(note.Event, "_", " "))
+	}
+}
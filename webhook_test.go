@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWebhook answers with each of statuses in turn, then 200s, and records
+// the bodies it was sent.
+func fakeWebhook(t *testing.T, statuses ...int) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var bodies []string
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body, err = io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies
+	}
+}
+
+func testWebhookConfig(urls ...string) webhookConfig {
+	return webhookConfig{
+		urls:        urls,
+		template:    defaultWebhookTemplate,
+		contentType: "application/json",
+		events:      strings.Split(defaultWebhookEvents, ","),
+		dedup:       5 * time.Minute,
+		retries:     3,
+		backoff:     time.Millisecond,
+	}
+}
+
+func TestWebhookNotifierRetry(t *testing.T) {
+	t.Parallel()
+
+	var flaky, flakyBodies = fakeWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	var broken, brokenBodies = fakeWebhook(t, http.StatusBadRequest)
+
+	var notifier, err = newWebhookNotifier(testWebhookConfig(flaky.URL, broken.URL))
+	assert.NoError(t, err)
+
+	var status, _ = parsePowerStatus(testOutputBlackout)
+	var note, ok = notifier.notification(upsEvent{
+		name:   eventOnBattery,
+		ups:    "rack1",
+		time:   time.Date(2023, 3, 9, 13, 38, 21, 0, time.UTC),
+		device: Device{ModelName: "CP1500PFCLCDa"},
+		status: status,
+	})
+	assert.True(t, ok)
+	notifier.send(context.Background(), note)
+
+	var expected = `{"text": "rack1 (CP1500PFCLCDa) is on battery, 39% battery and 24m0s runtime left"}`
+	assert.Equal(t, []string{expected, expected, expected}, flakyBodies())
+	// client errors are not retried
+	assert.Equal(t, []string{expected}, brokenBodies())
+
+	assert.NoError(t, testutil.CollectAndCompare(notifier, strings.NewReader(`
+# HELP cyber_power_exporter_webhook_notifications_total webhook notifications by result, failed ones were given up on after retrying
+# TYPE cyber_power_exporter_webhook_notifications_total counter
+cyber_power_exporter_webhook_notifications_total{result="failed"} 1
+cyber_power_exporter_webhook_notifications_total{result="sent"} 1
+`)))
+}
+
+func TestWebhookNotifierDedupAndRestore(t *testing.T) {
+	t.Parallel()
+
+	var notifier, err = newWebhookNotifier(testWebhookConfig())
+	assert.NoError(t, err)
+
+	var start = time.Date(2023, 3, 9, 13, 0, 0, 0, time.UTC)
+	var now = start
+	notifier.now = func() time.Time { return now }
+	var event = func(name string, at time.Duration) (notification, bool) {
+		now = start.Add(at)
+		return notifier.notification(upsEvent{name: name, ups: "rack1", time: start.Add(at)})
+	}
+
+	var _, ok = event(eventOnBattery, 0)
+	assert.True(t, ok)
+	note, ok := event(eventOnUtility, 90*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Second, note.OutageDuration)
+	assert.Equal(t, "rack1 is back on utility power after 1m30s on battery", note.Message)
+
+	// utility power flaps within the dedup window, the restore still knows how
+	// long the last outage was
+	_, ok = event(eventOnBattery, 2*time.Minute)
+	assert.False(t, ok)
+	note, ok = event(eventOnUtility, 2*time.Minute+10*time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, note.OutageDuration)
+
+	// after the window they are sent again
+	_, ok = event(eventOnBattery, 10*time.Minute)
+	assert.True(t, ok)
+
+	// events not configured are not sent
+	_, ok = event(eventPowerFailure, 10*time.Minute)
+	assert.False(t, ok)
+
+	assert.NoError(t, testutil.CollectAndCompare(notifier, strings.NewReader(`
+# HELP cyber_power_exporter_webhook_notifications_total webhook notifications by result, failed ones were given up on after retrying
+# TYPE cyber_power_exporter_webhook_notifications_total counter
+cyber_power_exporter_webhook_notifications_total{result="suppressed"} 2
+`)))
+}
+
+func TestWebhookNotifierDedupLostCommunication(t *testing.T) {
+	t.Parallel()
+
+	var notifier, err = newWebhookNotifier(testWebhookConfig())
+	assert.NoError(t, err)
+
+	var now = time.Date(2023, 3, 9, 13, 0, 0, 0, time.UTC)
+	notifier.now = func() time.Time { return now }
+
+	// a lost UPS reports no time of its own, the dedup window follows the
+	// notifier's clock
+	var _, ok = notifier.notification(upsEvent{name: eventCommunicationLost, ups: "rack1"})
+	assert.True(t, ok)
+	now = now.Add(time.Minute)
+	_, ok = notifier.notification(upsEvent{name: eventCommunicationLost, ups: "rack1"})
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour)
+	_, ok = notifier.notification(upsEvent{name: eventCommunicationLost, ups: "rack1"})
+	assert.True(t, ok)
+}
+
+func TestWebhookNotifierTemplate(t *testing.T) {
+	t.Parallel()
+
+	var server, bodies = fakeWebhook(t)
+	var config = testWebhookConfig(server.URL)
+	config.template = `{"content": {{json (printf "%s on %s: %d%%" .Event .UPS .Status.BatteryCapacity)}}}`
+
+	var notifier, err = newWebhookNotifier(config)
+	assert.NoError(t, err)
+	var note, _ = notifier.notification(upsEvent{name: eventLowBattery, ups: `rack "1"`, status: DeviceStatus{BatteryCapacity: 9}})
+	notifier.send(context.Background(), note)
+	assert.Equal(t, []string{`{"content": "low_battery on rack \"1\": 9%"}`}, bodies())
+
+	config.template = "{{.Nope"
+	_, err = newWebhookNotifier(config)
+	assert.Error(t, err)
+}